@@ -23,6 +23,17 @@ func (ene ErrNetlinkError) Error() string {
 	return fmt.Sprintf("netlink: %s error: %s", ene.Action, ene.Err)
 }
 
+// ErrLinkExists is returned when a link a network needs exists already and
+// was not created by polyp
+type ErrLinkExists string
+
+func (ele ErrLinkExists) Error() string {
+	return fmt.Sprintf("Link %s exists and was not created by polyp", string(ele))
+}
+
+// Forbidden denotes the type of this error
+func (ele ErrLinkExists) Forbidden() {}
+
 // ErrNoNetwork is returned if no network with the specified id exists
 type ErrNoNetwork string
 
@@ -73,3 +84,129 @@ func (ar ErrActiveRegistration) Error() string {
 
 // Forbidden denotes the type of this error
 func (ar ErrActiveRegistration) Forbidden() {}
+
+// ErrDhcpNak is returned when a DHCP server refuses a request
+type ErrDhcpNak string
+
+func (edn ErrDhcpNak) Error() string {
+	if string(edn) == "" {
+		return "dhcp server refused the request"
+	}
+	return fmt.Sprintf("dhcp server refused the request: %s", string(edn))
+}
+
+// Forbidden denotes the type of this error
+func (edn ErrDhcpNak) Forbidden() {}
+
+// ErrDhcp6Status is returned when a DHCPv6 server answers with a status
+// other than success
+type ErrDhcp6Status struct {
+	Code    uint16
+	Message string
+}
+
+func (eds ErrDhcp6Status) Error() string {
+	if eds.Message == "" {
+		return fmt.Sprintf("dhcpv6 server refused the request with status %d", eds.Code)
+	}
+	return fmt.Sprintf("dhcpv6 server refused the request with status %d: %s", eds.Code, eds.Message)
+}
+
+// Forbidden denotes the type of this error
+func (eds ErrDhcp6Status) Forbidden() {}
+
+// ErrDhcpTimeout is returned when no DHCP server answered in time
+type ErrDhcpTimeout string
+
+func (edt ErrDhcpTimeout) Error() string {
+	return fmt.Sprintf("no %s received from dhcp server", string(edt))
+}
+
+// Timeout denotes the type of this error
+func (edt ErrDhcpTimeout) Timeout() {}
+
+// ErrAddressConflict is returned when every address DHCP servers offered is
+// already in use on the network
+type ErrAddressConflict string
+
+func (eac ErrAddressConflict) Error() string {
+	return fmt.Sprintf("address %s is already in use on the network", string(eac))
+}
+
+// Retry denotes the type of this error
+func (eac ErrAddressConflict) Retry() {}
+
+// ErrAddressRefused is returned when the address which was asked for can not
+// be handed out
+type ErrAddressRefused struct {
+	Address string
+	Reason  string
+}
+
+func (ear ErrAddressRefused) Error() string {
+	return fmt.Sprintf("address %s refused: %s", ear.Address, ear.Reason)
+}
+
+// Forbidden denotes the type of this error
+func (ear ErrAddressRefused) Forbidden() {}
+
+// ErrAddressInUse is returned when a specific address is asked for which is
+// already allocated
+type ErrAddressInUse string
+
+func (eiu ErrAddressInUse) Error() string {
+	return fmt.Sprintf("address %s is already allocated", string(eiu))
+}
+
+// Forbidden denotes the type of this error
+func (eiu ErrAddressInUse) Forbidden() {}
+
+// ErrPoolExhausted is returned when a range has no free address left
+type ErrPoolExhausted string
+
+func (epe ErrPoolExhausted) Error() string {
+	return fmt.Sprintf("no free address left in %s", string(epe))
+}
+
+// NoService denotes the type of this error
+func (epe ErrPoolExhausted) NoService() {}
+
+// ErrNoPool is returned if no pool with the specified id exists
+type ErrNoPool string
+
+func (enp ErrNoPool) Error() string {
+	return fmt.Sprintf("No pool (%s) exists", string(enp))
+}
+
+// NotFound denotes the type of this error
+func (enp ErrNoPool) NotFound() {}
+
+// ErrPoolConflict is returned when a pool overlaps another one of the same
+// address space
+type ErrPoolConflict struct {
+	Pool     string
+	Existing string
+}
+
+func (epc ErrPoolConflict) Error() string {
+	return fmt.Sprintf("pool %s overlaps with existing pool %s", epc.Pool, epc.Existing)
+}
+
+// Forbidden denotes the type of this error
+func (epc ErrPoolConflict) Forbidden() {}
+
+// ErrRestStatus is returned when an external IPAM answers a call with an
+// unexpected status
+type ErrRestStatus struct {
+	Method string
+	URL    string
+	Status int
+	Body   string
+}
+
+func (ers ErrRestStatus) Error() string {
+	return fmt.Sprintf("rest ipam: %s %s returned %d: %s", ers.Method, ers.URL, ers.Status, ers.Body)
+}
+
+// NoService denotes the type of this error
+func (ers ErrRestStatus) NoService() {}
@@ -0,0 +1,235 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/libkv/store"
+)
+
+// fileStore is a store.Store kept in a single JSON file, for state which
+// belongs to this host only. Every change rewrites the file.
+type fileStore struct {
+	sync.Mutex
+	path  string
+	index uint64
+	kv    map[string]*store.KVPair
+}
+
+// NewFileStore opens the store kept at path, creating it when missing
+func NewFileStore(path string) (store.Store, error) {
+	fs := &fileStore{
+		path: path,
+		kv:   make(map[string]*store.KVPair),
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, os.MkdirAll(filepath.Dir(path), 0755)
+	} else if err != nil {
+		return nil, err
+	}
+	var pairs []*store.KVPair
+	if err := json.Unmarshal(b, &pairs); err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		fs.kv[pair.Key] = pair
+		if pair.LastIndex > fs.index {
+			fs.index = pair.LastIndex
+		}
+	}
+	return fs, nil
+}
+
+func normalize(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// commit applies change to a copy of the pairs, which replaces them once
+// written out. A failed write leaves the store as it was.
+func (fs *fileStore) commit(change func(kv map[string]*store.KVPair)) error {
+	kv := make(map[string]*store.KVPair, len(fs.kv)+1)
+	for k, pair := range fs.kv {
+		kv[k] = pair
+	}
+	change(kv)
+	if err := fs.flush(kv); err != nil {
+		return err
+	}
+	fs.kv = kv
+	return nil
+}
+
+// flush writes kv out, replacing the file only once fully written and
+// synced, so that a crash leaves either the old state or the new one
+func (fs *fileStore) flush(kv map[string]*store.KVPair) error {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]*store.KVPair, len(keys))
+	for i, k := range keys {
+		pairs[i] = kv[k]
+	}
+	b, err := json.MarshalIndent(pairs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fs.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fs.path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(fs.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (fs *fileStore) set(key string, value []byte) (*store.KVPair, error) {
+	pair := &store.KVPair{Key: key, Value: value, LastIndex: fs.index + 1}
+	if err := fs.commit(func(kv map[string]*store.KVPair) { kv[key] = pair }); err != nil {
+		return nil, err
+	}
+	fs.index++
+	return pair, nil
+}
+
+func (fs *fileStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	fs.Lock()
+	defer fs.Unlock()
+	_, err := fs.set(normalize(key), value)
+	return err
+}
+
+func (fs *fileStore) Get(key string) (*store.KVPair, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	pair, ok := fs.kv[normalize(key)]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return pair, nil
+}
+
+func (fs *fileStore) Delete(key string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	key = normalize(key)
+	if _, ok := fs.kv[key]; !ok {
+		return store.ErrKeyNotFound
+	}
+	return fs.commit(func(kv map[string]*store.KVPair) { delete(kv, key) })
+}
+
+func (fs *fileStore) Exists(key string) (bool, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	_, ok := fs.kv[normalize(key)]
+	return ok, nil
+}
+
+func (fs *fileStore) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (fs *fileStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (fs *fileStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+// List returns all pairs under directory, like the consul backend does
+func (fs *fileStore) List(directory string) ([]*store.KVPair, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	directory = normalize(directory)
+	var pairs []*store.KVPair
+	for k, pair := range fs.kv {
+		if strings.HasPrefix(k, directory) {
+			pairs = append(pairs, pair)
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+func (fs *fileStore) DeleteTree(directory string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	directory = normalize(directory)
+	return fs.commit(func(kv map[string]*store.KVPair) {
+		for k := range kv {
+			if strings.HasPrefix(k, directory) {
+				delete(kv, k)
+			}
+		}
+	})
+}
+
+func (fs *fileStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	key = normalize(key)
+	cur, ok := fs.kv[key]
+	switch {
+	case previous == nil && ok:
+		return false, nil, store.ErrKeyExists
+	case previous != nil && !ok:
+		return false, nil, store.ErrKeyNotFound
+	case previous != nil && cur.LastIndex != previous.LastIndex:
+		return false, nil, store.ErrKeyModified
+	}
+	pair, err := fs.set(key, value)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, pair, nil
+}
+
+func (fs *fileStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	key = normalize(key)
+	cur, ok := fs.kv[key]
+	if !ok {
+		return false, store.ErrKeyNotFound
+	} else if cur.LastIndex != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	if err := fs.commit(func(kv map[string]*store.KVPair) { delete(kv, key) }); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (fs *fileStore) Close() {}
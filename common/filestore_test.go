@@ -0,0 +1,197 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/libkv/store"
+)
+
+// newTestStore returns a store kept in a new temporary directory, which
+// the caller removes
+func newTestStore(t *testing.T) (store.Store, string) {
+	dir, err := ioutil.TempDir("", "polyp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewFileStore(testStorePath(dir))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return st, dir
+}
+
+func testStorePath(dir string) string {
+	return filepath.Join(dir, "polyp", "local.json")
+}
+
+func TestFileStoreAtomicPut(t *testing.T) {
+	st, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	ok, first, err := st.AtomicPut("a/b", []byte("1"), nil, nil)
+	if !ok || err != nil {
+		t.Fatalf("creating a/b: %v, %v", ok, err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		previous *store.KVPair
+		err      error
+	}{
+		{"create existing", "a/b", nil, store.ErrKeyExists},
+		{"create existing, slashes differ", "/a/b/", nil, store.ErrKeyExists},
+		{"update missing", "a/c", first, store.ErrKeyNotFound},
+		{"update stale", "a/b", &store.KVPair{Key: "a/b", LastIndex: first.LastIndex + 1}, store.ErrKeyModified},
+		{"update current", "a/b", first, nil},
+		{"update replaced", "a/b", first, store.ErrKeyModified},
+	}
+	for _, tt := range tests {
+		ok, pair, err := st.AtomicPut(tt.key, []byte(tt.name), tt.previous, nil)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if ok != (tt.err == nil) || (pair != nil) != (tt.err == nil) {
+			t.Errorf("%s: got ok %v and pair %v", tt.name, ok, pair)
+		}
+	}
+	pair, err := st.Get("a/b")
+	if err != nil || string(pair.Value) != "update current" {
+		t.Errorf("a/b holds %v, %v", pair, err)
+	}
+}
+
+func TestFileStoreAtomicDelete(t *testing.T) {
+	st, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	_, first, err := st.AtomicPut("a/b", []byte("1"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := st.AtomicPut("a/b", []byte("2"), first, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		previous *store.KVPair
+		err      error
+	}{
+		{"no previous", "a/b", nil, store.ErrPreviousNotSpecified},
+		{"missing", "a/c", second, store.ErrKeyNotFound},
+		{"stale", "a/b", first, store.ErrKeyModified},
+		{"current", "a/b", second, nil},
+		{"deleted", "a/b", second, store.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		ok, err := st.AtomicDelete(tt.key, tt.previous)
+		if err != tt.err || ok != (tt.err == nil) {
+			t.Errorf("%s: got %v, %v, want error %v", tt.name, ok, err, tt.err)
+		}
+	}
+	if ok, _ := st.Exists("a/b"); ok {
+		t.Error("a/b still exists")
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	st, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	path := testStorePath(dir)
+	if err := st.Put("polyp/lease/a", []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("polyp/lease/b", []byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("polyp/pool/c", []byte("c"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete("polyp/lease/b"); err != nil {
+		t.Fatal(err)
+	}
+	_, last, err := st.AtomicPut("polyp/pool/d", []byte("d"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	st, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := st.List("polyp/lease")
+	if err != nil || len(pairs) != 1 || string(pairs[0].Value) != "a" {
+		t.Errorf("leases read back as %v, %v", pairs, err)
+	}
+	if _, err := st.Get("polyp/lease/b"); err != store.ErrKeyNotFound {
+		t.Errorf("deleted key read back: %v", err)
+	}
+	// Indexes carry on, so that pairs read before the restart stay valid
+	if ok, _, err := st.AtomicPut("polyp/pool/d", []byte("e"), last, nil); !ok || err != nil {
+		t.Errorf("updating with a pair from before reopening: %v, %v", ok, err)
+	}
+	if _, pair, _ := st.AtomicPut("polyp/pool/f", []byte("f"), nil, nil); pair == nil || pair.LastIndex <= last.LastIndex {
+		t.Errorf("index went back to %v after reopening, was %d", pair, last.LastIndex)
+	}
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	st, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	path := testStorePath(dir)
+	if err := st.Put("a", []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The temporary file can not be created in place of a directory
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("a", []byte("2"), nil); err == nil {
+		t.Error("put succeeded")
+	}
+	if _, _, err := st.AtomicPut("b", []byte("1"), nil, nil); err == nil {
+		t.Error("atomic put succeeded")
+	}
+	if err := st.Delete("a"); err == nil {
+		t.Error("delete succeeded")
+	}
+	if err := st.DeleteTree("a"); err == nil {
+		t.Error("tree delete succeeded")
+	}
+	pair, err := st.Get("a")
+	if err != nil || string(pair.Value) != "1" {
+		t.Fatalf("a read back as %v, %v", pair, err)
+	}
+	if ok, err := st.AtomicDelete("a", pair); ok || err == nil {
+		t.Errorf("atomic delete: %v, %v", ok, err)
+	}
+	if ok, _ := st.Exists("b"); ok {
+		t.Error("b exists")
+	}
+
+	// Nothing failed writes did shows up once writing works again
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.AtomicPut("a", []byte("3"), pair, nil); err != nil {
+		t.Errorf("atomic put after failures: %v", err)
+	}
+	st, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair, err := st.Get("a"); err != nil || string(pair.Value) != "3" {
+		t.Errorf("a read back as %v, %v", pair, err)
+	}
+	if ok, _ := st.Exists("b"); ok {
+		t.Error("b written")
+	}
+}
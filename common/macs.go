@@ -0,0 +1,35 @@
+package common
+
+import (
+	"net"
+
+	"github.com/docker/libkv/store"
+)
+
+func _mac(mac net.HardwareAddr) string {
+	return "polyp/mac/" + mac.String()
+}
+
+// RegisterMAC records mac as belonging to a polyp endpoint, the embedded
+// DHCP server answers registered hardware addresses only
+func RegisterMAC(st store.Store, mac net.HardwareAddr, owner string) error {
+	return st.Put(_mac(mac), []byte(owner), nil)
+}
+
+// UnregisterMAC forgets mac, missing records are fine
+func UnregisterMAC(st store.Store, mac net.HardwareAddr) error {
+	if err := st.Delete(_mac(mac)); err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// RegisteredMAC reports whether mac was registered in any of stores
+func RegisteredMAC(mac net.HardwareAddr, stores ...store.Store) bool {
+	for _, st := range stores {
+		if ok, err := st.Exists(_mac(mac)); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
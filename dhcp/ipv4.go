@@ -0,0 +1,76 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	ipv4HeaderLen = 20
+	udpHeaderLen  = 8
+	protocolUDP   = 17
+)
+
+// Encapsulate wraps payload into UDP and IPv4 headers, for sending DHCP
+// over packet sockets where the kernel IP stack can not be used
+func Encapsulate(payload []byte, src, dst net.IP, sport, dport int) []byte {
+	n := ipv4HeaderLen + udpHeaderLen + len(payload)
+	b := make([]byte, n)
+
+	ip := b[:ipv4HeaderLen]
+	ip[0] = 0x45 // version 4, 5 words of header
+	binary.BigEndian.PutUint16(ip[2:4], uint16(n))
+	ip[8] = 64 // TTL
+	ip[9] = protocolUDP
+	copy(ip[12:16], ip4(src))
+	copy(ip[16:20], ip4(dst))
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+
+	udp := b[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dport))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpHeaderLen+len(payload)))
+	// UDP checksum is optional over IPv4 and left zero
+	copy(udp[udpHeaderLen:], payload)
+	return b
+}
+
+// Decapsulate returns the UDP payload of an IPv4 packet sent to dport, along
+// with its source address. ok is false for any other packet.
+func Decapsulate(b []byte, dport int) (payload []byte, src net.IP, ok bool) {
+	if len(b) < ipv4HeaderLen || b[0]>>4 != 4 || b[9] != protocolUDP {
+		return nil, nil, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < ipv4HeaderLen || total > len(b) || total < ihl+udpHeaderLen {
+		return nil, nil, false
+	}
+	// Fragments are of no interest to us
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return nil, nil, false
+	}
+	udp := b[ihl:total]
+	if int(binary.BigEndian.Uint16(udp[2:4])) != dport {
+		return nil, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < udpHeaderLen || length > len(udp) {
+		return nil, nil, false
+	}
+	return udp[udpHeaderLen:length], copyIP(b[12:16]), true
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
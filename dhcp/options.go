@@ -0,0 +1,296 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+type OptionCode byte
+
+const (
+	OptionPad                  OptionCode = 0
+	OptionSubnetMask           OptionCode = 1
+	OptionRouter               OptionCode = 3
+	OptionDomainNameServer     OptionCode = 6
+	OptionHostName             OptionCode = 12
+	OptionDomainName           OptionCode = 15
+	OptionBroadcastAddress     OptionCode = 28
+	OptionRequestedIPAddress   OptionCode = 50
+	OptionIPAddressLeaseTime   OptionCode = 51
+	OptionMessageType          OptionCode = 53
+	OptionServerIdentifier     OptionCode = 54
+	OptionParameterRequestList OptionCode = 55
+	OptionMessage              OptionCode = 56
+	OptionMaximumMessageSize   OptionCode = 57
+	OptionRenewalTime          OptionCode = 58
+	OptionRebindingTime        OptionCode = 59
+	OptionClientIdentifier     OptionCode = 61
+	OptionRelayAgentInfo       OptionCode = 82
+	OptionSubnetSelection      OptionCode = 118
+	OptionDomainSearch         OptionCode = 119
+	OptionClasslessRoute       OptionCode = 121
+	OptionEnd                  OptionCode = 255
+)
+
+// Sub-options of the relay agent information option (RFC 3046)
+const (
+	AgentCircuitID byte = 1
+	AgentRemoteID  byte = 2
+)
+
+// Options holds raw option values keyed by their code
+type Options map[OptionCode][]byte
+
+// marshal appends options to b, message type first and relay agent
+// information last, splitting values longer than 255 bytes as described
+// in RFC 3396
+func (o Options) marshal(b []byte) []byte {
+	codes := make([]int, 0, len(o))
+	for code := range o {
+		if code == OptionPad || code == OptionEnd || code == OptionMessageType || code == OptionRelayAgentInfo {
+			continue
+		}
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	if _, ok := o[OptionMessageType]; ok {
+		codes = append([]int{int(OptionMessageType)}, codes...)
+	}
+	if _, ok := o[OptionRelayAgentInfo]; ok {
+		codes = append(codes, int(OptionRelayAgentInfo))
+	}
+	for _, code := range codes {
+		v := o[OptionCode(code)]
+		for {
+			n := len(v)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, byte(code), byte(n))
+			b = append(b, v[:n]...)
+			v = v[n:]
+			if len(v) == 0 {
+				break
+			}
+		}
+	}
+	return append(b, byte(OptionEnd))
+}
+
+// unmarshalOptions parses the options field, concatenating options which
+// appear multiple times (RFC 3396)
+func unmarshalOptions(b []byte) (Options, error) {
+	o := make(Options)
+	for len(b) > 0 {
+		code := OptionCode(b[0])
+		if code == OptionEnd {
+			break
+		}
+		if code == OptionPad {
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, ErrBadOptionLen
+		}
+		n := int(b[1])
+		o[code] = append(o[code], b[2:2+n]...)
+		b = b[2+n:]
+	}
+	return o, nil
+}
+
+// IP returns the first address of an address option, or nil
+func (o Options) IP(code OptionCode) net.IP {
+	if ips := o.IPs(code); len(ips) > 0 {
+		return ips[0]
+	}
+	return nil
+}
+
+// IPs returns all addresses of an address list option
+func (o Options) IPs(code OptionCode) []net.IP {
+	v := o[code]
+	ips := make([]net.IP, 0, len(v)/4)
+	for ; len(v) >= 4; v = v[4:] {
+		ips = append(ips, copyIP(v))
+	}
+	return ips
+}
+
+// SetIP stores one or more addresses in an option
+func (o Options) SetIP(code OptionCode, ips ...net.IP) {
+	v := make([]byte, 0, 4*len(ips))
+	for _, ip := range ips {
+		v = append(v, ip4(ip)...)
+	}
+	o[code] = v
+}
+
+// Mask returns the subnet mask option, or nil
+func (o Options) Mask() net.IPMask {
+	if v := o[OptionSubnetMask]; len(v) == 4 {
+		return net.IPv4Mask(v[0], v[1], v[2], v[3])
+	}
+	return nil
+}
+
+// Duration returns a time option given in seconds, or 0
+func (o Options) Duration(code OptionCode) time.Duration {
+	if v := o[code]; len(v) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return 0
+}
+
+// SetDuration stores a time option with a second precision
+func (o Options) SetDuration(code OptionCode, d time.Duration) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(d/time.Second))
+	o[code] = v
+}
+
+// SetUint16 stores a two byte integer option
+func (o Options) SetUint16(code OptionCode, n uint16) {
+	v := make([]byte, 2)
+	binary.BigEndian.PutUint16(v, n)
+	o[code] = v
+}
+
+// String returns a text option
+func (o Options) String(code OptionCode) string {
+	return string(o[code])
+}
+
+// SetRequestList sets the parameter request list option
+func (o Options) SetRequestList(codes ...OptionCode) {
+	v := make([]byte, len(codes))
+	for i, code := range codes {
+		v[i] = byte(code)
+	}
+	o[OptionParameterRequestList] = v
+}
+
+// SetAgentInfo stores the relay agent information option with circuit and
+// remote ID sub-options, empty ones are left out
+func (o Options) SetAgentInfo(circuitID, remoteID string) {
+	var v []byte
+	for _, sub := range []struct {
+		code  byte
+		value string
+	}{{AgentCircuitID, circuitID}, {AgentRemoteID, remoteID}} {
+		if sub.value == "" {
+			continue
+		}
+		if len(sub.value) > 255 {
+			sub.value = sub.value[:255]
+		}
+		v = append(v, sub.code, byte(len(sub.value)))
+		v = append(v, sub.value...)
+	}
+	o[OptionRelayAgentInfo] = v
+}
+
+// AgentInfo returns the sub-options of the relay agent information option
+func (o Options) AgentInfo() (map[byte][]byte, error) {
+	v := o[OptionRelayAgentInfo]
+	subs := map[byte][]byte{}
+	for len(v) > 0 {
+		if len(v) < 2 || len(v) < 2+int(v[1]) {
+			return nil, ErrBadOptionLen
+		}
+		subs[v[0]] = v[2 : 2+int(v[1])]
+		v = v[2+int(v[1]):]
+	}
+	return subs, nil
+}
+
+// Route is a classless static route (RFC 3442)
+type Route struct {
+	Destination *net.IPNet
+	// Router is 0.0.0.0 for destinations reachable on the link
+	Router net.IP
+}
+
+// ClasslessRoutes decodes the classless static route option
+func (o Options) ClasslessRoutes() ([]Route, error) {
+	var (
+		v      = o[OptionClasslessRoute]
+		routes []Route
+	)
+	for len(v) > 0 {
+		width := int(v[0])
+		if width > 32 {
+			return nil, ErrBadOptionLen
+		}
+		n := (width + 7) / 8
+		if len(v) < 1+n+4 {
+			return nil, ErrBadOptionLen
+		}
+		dst := make(net.IP, 4)
+		copy(dst, v[1:1+n])
+		routes = append(routes, Route{
+			Destination: &net.IPNet{IP: dst, Mask: net.CIDRMask(width, 32)},
+			Router:      copyIP(v[1+n : 5+n]),
+		})
+		v = v[5+n:]
+	}
+	return routes, nil
+}
+
+// DomainSearch decodes the domain search option (RFC 3397), names are
+// encoded as in DNS with compression pointers into the option itself
+func (o Options) DomainSearch() ([]string, error) {
+	var (
+		v       = o[OptionDomainSearch]
+		domains []string
+	)
+	for i := 0; i < len(v); {
+		name, next, err := readName(v, i)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, name)
+		i = next
+	}
+	return domains, nil
+}
+
+// readName reads a DNS encoded name at i, returning it together with the
+// offset following it
+func readName(v []byte, i int) (string, int, error) {
+	var (
+		labels []string
+		next   = -1
+	)
+	for jumps := 0; ; jumps++ {
+		if i >= len(v) || jumps > len(v) {
+			return "", 0, ErrBadOptionLen
+		}
+		n := int(v[i])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = i + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if i+1 >= len(v) {
+				return "", 0, ErrBadOptionLen
+			}
+			if next < 0 {
+				next = i + 2
+			}
+			i = (n&0x3f)<<8 | int(v[i+1])
+		default:
+			if i+1+n > len(v) {
+				return "", 0, ErrBadOptionLen
+			}
+			labels = append(labels, string(v[i+1:i+1+n]))
+			i += 1 + n
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsRoundTrip(t *testing.T) {
+	long := []byte(strings.Repeat("x", 600))
+	tests := []struct {
+		name string
+		o    Options
+	}{
+		{"empty", Options{}},
+		{"message type", Options{OptionMessageType: {byte(Offer)}}},
+		{"addresses", Options{OptionRouter: {10, 1, 0, 1}, OptionDomainNameServer: {10, 1, 0, 53, 10, 1, 0, 54}}},
+		{"empty value", Options{OptionHostName: nil}},
+		// Values past 255 bytes are split and joined again (RFC 3396)
+		{"long value", Options{OptionDomainSearch: long}},
+		{"agent info", Options{OptionMessageType: {byte(Request)}, OptionRelayAgentInfo: {1, 1, 'a'}, OptionHostName: []byte("web")}},
+	}
+	for _, tt := range tests {
+		b := tt.o.marshal(nil)
+		if b[len(b)-1] != byte(OptionEnd) {
+			t.Errorf("%s: not terminated", tt.name)
+		}
+		got, err := unmarshalOptions(b)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.o) {
+			t.Errorf("%s: read back as %v", tt.name, got)
+		}
+	}
+}
+
+func TestOptionsOrder(t *testing.T) {
+	o := Options{
+		OptionRelayAgentInfo: {2, 1, 'h'},
+		OptionRouter:         {10, 1, 0, 1},
+		OptionMessageType:    {byte(Discover)},
+		OptionSubnetMask:     {255, 255, 255, 0},
+	}
+	b := o.marshal(nil)
+	var codes []OptionCode
+	for len(b) > 1 {
+		codes = append(codes, OptionCode(b[0]))
+		b = b[2+int(b[1]):]
+	}
+	want := []OptionCode{OptionMessageType, OptionSubnetMask, OptionRouter, OptionRelayAgentInfo}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("marshalled in order %v, want %v", codes, want)
+	}
+}
+
+func TestUnmarshalOptionsPadding(t *testing.T) {
+	b := []byte{0, 0, byte(OptionHostName), 1, 'a', 0, byte(OptionHostName), 1, 'b', byte(OptionEnd), byte(OptionRouter), 4}
+	o, err := unmarshalOptions(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o) != 1 || o.String(OptionHostName) != "ab" {
+		t.Errorf("read %v", o)
+	}
+}
+
+func TestOptionValues(t *testing.T) {
+	o := Options{}
+	o.SetIP(OptionServerIdentifier, net.ParseIP("10.1.0.254"))
+	o.SetDuration(OptionRenewalTime, 90*time.Minute+500*time.Millisecond)
+	o.SetUint16(OptionMaximumMessageSize, 1500)
+	o[OptionSubnetMask] = net.CIDRMask(22, 32)
+
+	if ip := o.IP(OptionServerIdentifier); !ip.Equal(net.ParseIP("10.1.0.254")) {
+		t.Errorf("server identifier %v", ip)
+	}
+	if ip := o.IP(OptionRouter); ip != nil {
+		t.Errorf("missing router read as %v", ip)
+	}
+	if d := o.Duration(OptionRenewalTime); d != 90*time.Minute {
+		t.Errorf("renewal time %v", d)
+	}
+	if d := o.Duration(OptionRebindingTime); d != 0 {
+		t.Errorf("missing rebinding time read as %v", d)
+	}
+	if !bytes.Equal(o[OptionMaximumMessageSize], []byte{0x05, 0xdc}) {
+		t.Errorf("maximum message size %v", o[OptionMaximumMessageSize])
+	}
+	if m := o.Mask(); m.String() != net.CIDRMask(22, 32).String() {
+		t.Errorf("mask %v", m)
+	}
+}
+
+func TestAgentInfo(t *testing.T) {
+	tests := []struct {
+		circuit, remote string
+		want            map[byte][]byte
+	}{
+		{"vlan72:web", "host1", map[byte][]byte{AgentCircuitID: []byte("vlan72:web"), AgentRemoteID: []byte("host1")}},
+		{"vlan72:web", "", map[byte][]byte{AgentCircuitID: []byte("vlan72:web")}},
+		{"", "", map[byte][]byte{}},
+		{strings.Repeat("c", 300), "", map[byte][]byte{AgentCircuitID: []byte(strings.Repeat("c", 255))}},
+	}
+	for _, tt := range tests {
+		o := Options{}
+		o.SetAgentInfo(tt.circuit, tt.remote)
+		got, err := o.AgentInfo()
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q, %q: read back as %q, %v", tt.circuit, tt.remote, got, err)
+		}
+	}
+	if _, err := (Options{OptionRelayAgentInfo: {1, 5, 'a'}}).AgentInfo(); err != ErrBadOptionLen {
+		t.Errorf("truncated sub-option: %v", err)
+	}
+}
+
+func TestClasslessRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		v    []byte
+		want []string
+		err  error
+	}{
+		{"none", nil, nil, nil},
+		{"default", []byte{0, 10, 1, 0, 1}, []string{"0.0.0.0/0 via 10.1.0.1"}, nil},
+		{"on link and partial octets", []byte{24, 192, 168, 5, 0, 0, 0, 0, 12, 172, 16, 10, 1, 0, 2}, []string{"192.168.5.0/24 via 0.0.0.0", "172.16.0.0/12 via 10.1.0.2"}, nil},
+		{"host route", []byte{32, 10, 9, 0, 254, 10, 1, 0, 1}, []string{"10.9.0.254/32 via 10.1.0.1"}, nil},
+		{"width past 32", []byte{33, 1, 2, 3, 4, 5, 10, 1, 0, 1}, nil, ErrBadOptionLen},
+		{"truncated", []byte{24, 192, 168, 5, 10, 1}, nil, ErrBadOptionLen},
+	}
+	for _, tt := range tests {
+		routes, err := (Options{OptionClasslessRoute: tt.v}).ClasslessRoutes()
+		var got []string
+		for _, r := range routes {
+			got = append(got, r.Destination.String()+" via "+r.Router.String())
+		}
+		if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestDomainSearch(t *testing.T) {
+	tests := []struct {
+		name string
+		v    []byte
+		want []string
+		err  error
+	}{
+		{"none", nil, nil, nil},
+		{"single", []byte("\x07example\x03com\x00"), []string{"example.com"}, nil},
+		// The second name points back at "example.com" (RFC 3397 2)
+		{"compressed", []byte("\x07example\x03com\x00\x03eng\xc0\x00"), []string{"example.com", "eng.example.com"}, nil},
+		{"root", []byte{0}, []string{""}, nil},
+		{"label past the end", []byte("\x07exam"), nil, ErrBadOptionLen},
+		{"pointer past the end", []byte("\x03eng\xc0\x40"), nil, ErrBadOptionLen},
+		{"pointer loop", []byte("\xc0\x00"), nil, ErrBadOptionLen},
+	}
+	for _, tt := range tests {
+		got, err := (Options{OptionDomainSearch: tt.v}).DomainSearch()
+		if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Package dhcp implements encoding and decoding of DHCPv4 messages (RFC 2131)
+// as they are exchanged by polyp on behalf of containers.
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+type OpCode byte
+
+const (
+	BootRequest OpCode = 1
+	BootReply   OpCode = 2
+)
+
+type MessageType byte
+
+const (
+	Discover MessageType = iota + 1
+	Offer
+	Request
+	Decline
+	Ack
+	Nak
+	Release
+	Inform
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case Discover:
+		return "DHCPDISCOVER"
+	case Offer:
+		return "DHCPOFFER"
+	case Request:
+		return "DHCPREQUEST"
+	case Decline:
+		return "DHCPDECLINE"
+	case Ack:
+		return "DHCPACK"
+	case Nak:
+		return "DHCPNAK"
+	case Release:
+		return "DHCPRELEASE"
+	case Inform:
+		return "DHCPINFORM"
+	}
+	return fmt.Sprintf("DHCP(%d)", byte(t))
+}
+
+const (
+	ServerPort = 67
+	ClientPort = 68
+
+	// FlagBroadcast asks the server to broadcast its replies, as the client
+	// can not receive unicast packets yet
+	FlagBroadcast uint16 = 0x8000
+
+	htypeEthernet = 1
+	headerLen     = 236
+	minPacketLen  = 300
+)
+
+var (
+	magicCookie = []byte{99, 130, 83, 99}
+
+	ErrShortPacket  = errors.New("dhcp: packet too short")
+	ErrNoCookie     = errors.New("dhcp: magic cookie missing")
+	ErrBadOptionLen = errors.New("dhcp: option exceeds packet length")
+)
+
+// Packet is a single BOOTP/DHCP message
+type Packet struct {
+	Op      OpCode
+	HType   byte
+	HLen    byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options Options
+}
+
+// NewPacket prepares a message of given type for an ethernet client
+func NewPacket(t MessageType, xid uint32, chaddr net.HardwareAddr) *Packet {
+	op := BootRequest
+	if t == Offer || t == Ack || t == Nak {
+		op = BootReply
+	}
+	p := &Packet{
+		Op:      op,
+		HType:   htypeEthernet,
+		HLen:    byte(len(chaddr)),
+		XID:     xid,
+		CHAddr:  chaddr,
+		Options: make(Options),
+	}
+	p.Options[OptionMessageType] = []byte{byte(t)}
+	return p
+}
+
+// Type returns the DHCP message type, or 0 for plain BOOTP messages
+func (p *Packet) Type() MessageType {
+	if v := p.Options[OptionMessageType]; len(v) == 1 {
+		return MessageType(v[0])
+	}
+	return 0
+}
+
+func (p *Packet) String() string {
+	return fmt.Sprintf("%v xid=%08x chaddr=%v ciaddr=%v yiaddr=%v giaddr=%v",
+		p.Type(), p.XID, p.CHAddr, p.CIAddr, p.YIAddr, p.GIAddr)
+}
+
+// Marshal encodes the packet into its wire format
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, headerLen, minPacketLen)
+	b[0] = byte(p.Op)
+	b[1] = p.HType
+	b[2] = p.HLen
+	b[3] = p.Hops
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], ip4(p.CIAddr))
+	copy(b[16:20], ip4(p.YIAddr))
+	copy(b[20:24], ip4(p.SIAddr))
+	copy(b[24:28], ip4(p.GIAddr))
+	copy(b[28:44], p.CHAddr)
+
+	b = append(b, magicCookie...)
+	b = p.Options.marshal(b)
+	for len(b) < minPacketLen {
+		b = append(b, byte(OptionPad))
+	}
+	return b
+}
+
+// Unmarshal decodes a packet from its wire format
+func Unmarshal(b []byte) (*Packet, error) {
+	if len(b) < headerLen+len(magicCookie) {
+		return nil, ErrShortPacket
+	}
+	if !bytes.Equal(b[headerLen:headerLen+len(magicCookie)], magicCookie) {
+		return nil, ErrNoCookie
+	}
+	p := &Packet{
+		Op:     OpCode(b[0]),
+		HType:  b[1],
+		HLen:   b[2],
+		Hops:   b[3],
+		XID:    binary.BigEndian.Uint32(b[4:8]),
+		Secs:   binary.BigEndian.Uint16(b[8:10]),
+		Flags:  binary.BigEndian.Uint16(b[10:12]),
+		CIAddr: copyIP(b[12:16]),
+		YIAddr: copyIP(b[16:20]),
+		SIAddr: copyIP(b[20:24]),
+		GIAddr: copyIP(b[24:28]),
+	}
+	hlen := int(p.HLen)
+	if hlen > 16 {
+		hlen = 16
+	}
+	p.CHAddr = net.HardwareAddr(append([]byte(nil), b[28:28+hlen]...))
+
+	var err error
+	if p.Options, err = unmarshalOptions(b[headerLen+len(magicCookie):]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func ip4(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return net.IPv4zero.To4()
+}
+
+func copyIP(b []byte) net.IP {
+	return net.IPv4(b[0], b[1], b[2], b[3]).To4()
+}
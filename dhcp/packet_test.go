@@ -0,0 +1,103 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:00:00:05")
+	discover := NewPacket(Discover, 0x01020304, mac)
+	discover.Flags = FlagBroadcast
+	discover.Options.SetRequestList(OptionSubnetMask, OptionRouter, OptionDomainNameServer)
+	discover.Options[OptionClientIdentifier] = append([]byte{htypeEthernet}, mac...)
+
+	ack := NewPacket(Ack, 0xdeadbeef, mac)
+	ack.Hops = 1
+	ack.Secs = 3
+	ack.CIAddr = net.ParseIP("10.1.0.5")
+	ack.YIAddr = net.ParseIP("10.1.0.5")
+	ack.SIAddr = net.ParseIP("10.1.0.254")
+	ack.GIAddr = net.ParseIP("10.2.0.1")
+	ack.Options.SetIP(OptionSubnetMask, net.IP(net.CIDRMask(24, 32)))
+	ack.Options.SetIP(OptionDomainNameServer, net.ParseIP("10.1.0.53"), net.ParseIP("10.1.0.54"))
+	ack.Options.SetDuration(OptionIPAddressLeaseTime, time.Hour)
+	ack.Options.SetAgentInfo("vlan72:web", "host1")
+
+	for _, p := range []*Packet{discover, ack} {
+		b := p.Marshal()
+		if len(b) < minPacketLen {
+			t.Errorf("%v: %d bytes, shorter than BOOTP allows", p, len(b))
+		}
+		got, err := Unmarshal(b)
+		if err != nil {
+			t.Errorf("%v: %v", p, err)
+			continue
+		}
+		// Unset addresses come back as 0.0.0.0
+		for _, ip := range []*net.IP{&p.CIAddr, &p.YIAddr, &p.SIAddr, &p.GIAddr} {
+			*ip = ip4(*ip)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("%v: read back as %+v, want %+v", p, got, p)
+		}
+	}
+	if discover.Type() != Discover || ack.Type() != Ack {
+		t.Errorf("types read back as %v and %v", discover.Type(), ack.Type())
+	}
+	if ack.Op != BootReply || discover.Op != BootRequest {
+		t.Errorf("op codes %v and %v", discover.Op, ack.Op)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:00:00:05")
+	valid := NewPacket(Request, 1, mac).Marshal()
+	noCookie := append([]byte(nil), valid...)
+	noCookie[headerLen] = 0
+	badOption := append(append([]byte(nil), valid[:headerLen+len(magicCookie)]...), byte(OptionHostName), 10, 'a')
+
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"empty", nil, ErrShortPacket},
+		{"header only", valid[:headerLen], ErrShortPacket},
+		{"no cookie", noCookie, ErrNoCookie},
+		{"option past the end", badOption, ErrBadOptionLen},
+	}
+	for _, tt := range tests {
+		if _, err := Unmarshal(tt.b); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestEncapsulate(t *testing.T) {
+	payload := []byte("dhcp")
+	src, dst := net.ParseIP("0.0.0.0"), net.ParseIP("255.255.255.255")
+	b := Encapsulate(payload, src, dst, ClientPort, ServerPort)
+	if checksum(b[:ipv4HeaderLen]) != 0 {
+		t.Error("bad IPv4 header checksum")
+	}
+
+	got, from, ok := Decapsulate(b, ServerPort)
+	if !ok || !bytes.Equal(got, payload) || !from.Equal(src) {
+		t.Errorf("decapsulated %q from %v, %v", got, from, ok)
+	}
+	if _, _, ok := Decapsulate(b, ClientPort); ok {
+		t.Error("decapsulated a packet to another port")
+	}
+	if _, _, ok := Decapsulate(b[:ipv4HeaderLen+4], ServerPort); ok {
+		t.Error("decapsulated a truncated packet")
+	}
+	fragment := append([]byte(nil), b...)
+	fragment[6] = 0x20
+	if _, _, ok := Decapsulate(fragment, ServerPort); ok {
+		t.Error("decapsulated a fragment")
+	}
+}
@@ -0,0 +1,86 @@
+package dhcp6
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	protocolUDP   = 17
+)
+
+// Encapsulate wraps payload into UDP and IPv6 headers, for sending DHCPv6
+// over packet sockets where the kernel IP stack can not be used. Messages
+// of clients are link local, so the hop limit is 1.
+func Encapsulate(payload []byte, src, dst net.IP, sport, dport int) []byte {
+	n := udpHeaderLen + len(payload)
+	b := make([]byte, ipv6HeaderLen+n)
+
+	ip := b[:ipv6HeaderLen]
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:6], uint16(n))
+	ip[6] = protocolUDP
+	ip[7] = 1
+	copy(ip[8:24], src.To16())
+	copy(ip[24:40], dst.To16())
+
+	udp := b[ipv6HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dport))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(n))
+	copy(udp[udpHeaderLen:], payload)
+	// UDP checksum is mandatory over IPv6
+	sum := checksum(ip[8:40], udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+	return b
+}
+
+// Decapsulate returns the UDP payload of an IPv6 packet sent to dport,
+// along with its source and destination addresses. ok is false for any
+// other packet, including those carrying extension headers.
+func Decapsulate(b []byte, dport int) (payload []byte, src, dst net.IP, ok bool) {
+	if len(b) < ipv6HeaderLen+udpHeaderLen || b[0]>>4 != 6 || b[6] != protocolUDP {
+		return nil, nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b[4:6]))
+	if n < udpHeaderLen || ipv6HeaderLen+n > len(b) {
+		return nil, nil, nil, false
+	}
+	udp := b[ipv6HeaderLen : ipv6HeaderLen+n]
+	if int(binary.BigEndian.Uint16(udp[2:4])) != dport {
+		return nil, nil, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < udpHeaderLen || length > len(udp) {
+		return nil, nil, nil, false
+	}
+	src = append(net.IP(nil), b[8:24]...)
+	dst = append(net.IP(nil), b[24:40]...)
+	return udp[udpHeaderLen:length], src, dst, true
+}
+
+// checksum sums the UDP datagram along with the IPv6 pseudo header, given
+// the source and destination addresses as they follow each other
+func checksum(addrs, udp []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(addrs)
+	sum += uint32(len(udp)) + protocolUDP
+	add(udp)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,251 @@
+package dhcp6
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+type OptionCode uint16
+
+const (
+	OptionClientID    OptionCode = 1
+	OptionServerID    OptionCode = 2
+	OptionIANA        OptionCode = 3
+	OptionIAAddr      OptionCode = 5
+	OptionRequestList OptionCode = 6
+	OptionPreference  OptionCode = 7
+	OptionElapsedTime OptionCode = 8
+	OptionStatusCode  OptionCode = 13
+	OptionRapidCommit OptionCode = 14
+	OptionDNSServers  OptionCode = 23
+	OptionDomainList  OptionCode = 24
+)
+
+// Status codes (RFC 3315 24.4)
+const (
+	StatusSuccess      uint16 = 0
+	StatusUnspecFail   uint16 = 1
+	StatusNoAddrsAvail uint16 = 2
+	StatusNoBinding    uint16 = 3
+	StatusNotOnLink    uint16 = 4
+	StatusUseMulticast uint16 = 5
+)
+
+// Options holds raw option values keyed by their code. Of options which
+// appear several times only the first is kept.
+type Options map[OptionCode][]byte
+
+func (o Options) marshal(b []byte) []byte {
+	codes := make([]int, 0, len(o))
+	for code := range o {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		v := o[OptionCode(code)]
+		h := make([]byte, 4)
+		binary.BigEndian.PutUint16(h[0:2], uint16(code))
+		binary.BigEndian.PutUint16(h[2:4], uint16(len(v)))
+		b = append(b, h...)
+		b = append(b, v...)
+	}
+	return b
+}
+
+func unmarshalOptions(b []byte) (Options, error) {
+	o := make(Options)
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrBadOptionLen
+		}
+		code := OptionCode(binary.BigEndian.Uint16(b[0:2]))
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+n {
+			return nil, ErrBadOptionLen
+		}
+		if _, ok := o[code]; !ok {
+			o[code] = b[4 : 4+n]
+		}
+		b = b[4+n:]
+	}
+	return o, nil
+}
+
+// DUIDLL builds a link-layer DUID (RFC 3315 9.4) of an ethernet address
+func DUIDLL(mac net.HardwareAddr) []byte {
+	return append([]byte{0, 3, 0, 1}, mac...)
+}
+
+// SetRequestList sets the option request option
+func (o Options) SetRequestList(codes ...OptionCode) {
+	v := make([]byte, 2*len(codes))
+	for i, code := range codes {
+		binary.BigEndian.PutUint16(v[2*i:], uint16(code))
+	}
+	o[OptionRequestList] = v
+}
+
+// SetElapsedTime stores the time since the exchange began in hundredths
+// of a second
+func (o Options) SetElapsedTime(d time.Duration) {
+	v := make([]byte, 2)
+	cs := d / (10 * time.Millisecond)
+	if cs > 0xffff {
+		cs = 0xffff
+	}
+	binary.BigEndian.PutUint16(v, uint16(cs))
+	o[OptionElapsedTime] = v
+}
+
+// Status returns the status code option, which means success when absent
+func (o Options) Status() (uint16, string) {
+	v, ok := o[OptionStatusCode]
+	if !ok || len(v) < 2 {
+		return StatusSuccess, ""
+	}
+	return binary.BigEndian.Uint16(v), string(v[2:])
+}
+
+// Preference returns the server preference, 0 when absent
+func (o Options) Preference() int {
+	if v := o[OptionPreference]; len(v) == 1 {
+		return int(v[0])
+	}
+	return 0
+}
+
+// IPs returns all addresses of an address list option
+func (o Options) IPs(code OptionCode) []net.IP {
+	v := o[code]
+	ips := make([]net.IP, 0, len(v)/16)
+	for ; len(v) >= 16; v = v[16:] {
+		ips = append(ips, append(net.IP(nil), v[:16]...))
+	}
+	return ips
+}
+
+// Domains decodes a domain list option, names are encoded as in DNS but
+// without compression (RFC 3315 8)
+func (o Options) Domains() ([]string, error) {
+	var (
+		v       = o[OptionDomainList]
+		domains []string
+		labels  []string
+	)
+	for len(v) > 0 {
+		n := int(v[0])
+		if n == 0 {
+			domains = append(domains, strings.Join(labels, "."))
+			labels = nil
+			v = v[1:]
+			continue
+		}
+		if len(v) < 1+n {
+			return nil, ErrBadOptionLen
+		}
+		labels = append(labels, string(v[1:1+n]))
+		v = v[1+n:]
+	}
+	return domains, nil
+}
+
+// IANA is an identity association for non-temporary addresses
+type IANA struct {
+	IAID    uint32
+	T1, T2  time.Duration
+	Options Options
+}
+
+// IANA returns the identity association option, or nil
+func (o Options) IANA() (*IANA, error) {
+	v, ok := o[OptionIANA]
+	if !ok {
+		return nil, nil
+	}
+	if len(v) < 12 {
+		return nil, ErrBadOptionLen
+	}
+	opts, err := unmarshalOptions(v[12:])
+	if err != nil {
+		return nil, err
+	}
+	return &IANA{
+		IAID:    binary.BigEndian.Uint32(v[0:4]),
+		T1:      seconds(v[4:8]),
+		T2:      seconds(v[8:12]),
+		Options: opts,
+	}, nil
+}
+
+// SetIANA stores an identity association option
+func (o Options) SetIANA(ia *IANA) {
+	v := make([]byte, 12)
+	binary.BigEndian.PutUint32(v[0:4], ia.IAID)
+	putSeconds(v[4:8], ia.T1)
+	putSeconds(v[8:12], ia.T2)
+	if ia.Options != nil {
+		v = ia.Options.marshal(v)
+	}
+	o[OptionIANA] = v
+}
+
+// IAAddr is an address of an identity association
+type IAAddr struct {
+	IP               net.IP
+	Preferred, Valid time.Duration
+	Options          Options
+}
+
+// Addr returns the first address of the association, or nil
+func (ia *IANA) Addr() (*IAAddr, error) {
+	v, ok := ia.Options[OptionIAAddr]
+	if !ok {
+		return nil, nil
+	}
+	if len(v) < 24 {
+		return nil, ErrBadOptionLen
+	}
+	opts, err := unmarshalOptions(v[24:])
+	if err != nil {
+		return nil, err
+	}
+	return &IAAddr{
+		IP:        append(net.IP(nil), v[0:16]...),
+		Preferred: seconds(v[16:20]),
+		Valid:     seconds(v[20:24]),
+		Options:   opts,
+	}, nil
+}
+
+// SetAddr stores a to the association
+func (ia *IANA) SetAddr(a *IAAddr) {
+	v := make([]byte, 24)
+	copy(v[0:16], a.IP.To16())
+	putSeconds(v[16:20], a.Preferred)
+	putSeconds(v[20:24], a.Valid)
+	if a.Options != nil {
+		v = a.Options.marshal(v)
+	}
+	if ia.Options == nil {
+		ia.Options = make(Options)
+	}
+	ia.Options[OptionIAAddr] = v
+}
+
+// Lifetime of 0xffffffff seconds, meaning forever
+const Infinity = 0xffffffff * time.Second
+
+func seconds(b []byte) time.Duration {
+	return time.Duration(binary.BigEndian.Uint32(b)) * time.Second
+}
+
+func putSeconds(b []byte, d time.Duration) {
+	if d >= Infinity {
+		binary.BigEndian.PutUint32(b, 0xffffffff)
+		return
+	}
+	binary.BigEndian.PutUint32(b, uint32(d/time.Second))
+}
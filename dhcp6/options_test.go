@@ -0,0 +1,125 @@
+package dhcp6
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptionsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+	}{
+		{"empty", Options{}},
+		{"client id", Options{OptionClientID: {0, 3, 0, 1, 2, 66, 10, 0, 0, 5}}},
+		{"several", Options{OptionServerID: {0, 1}, OptionPreference: {255}, OptionStatusCode: {0, 2, 'n', 'o'}}},
+		{"empty value", Options{OptionRapidCommit: {}}},
+	}
+	for _, tt := range tests {
+		got, err := unmarshalOptions(tt.o.marshal(nil))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.o) {
+			t.Errorf("%s: read back as %v", tt.name, got)
+		}
+	}
+}
+
+func TestUnmarshalOptionsRepeated(t *testing.T) {
+	b := []byte{0, 7, 0, 1, 10, 0, 7, 0, 1, 20}
+	o, err := unmarshalOptions(b)
+	if err != nil || o.Preference() != 10 {
+		t.Errorf("read %v, %v, want the first preference", o, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+		code uint16
+		msg  string
+	}{
+		{"absent", Options{}, StatusSuccess, ""},
+		{"too short", Options{OptionStatusCode: {2}}, StatusSuccess, ""},
+		{"without message", Options{OptionStatusCode: {0, 3}}, StatusNoBinding, ""},
+		{"with message", Options{OptionStatusCode: append([]byte{0, 2}, "pool full"...)}, StatusNoAddrsAvail, "pool full"},
+	}
+	for _, tt := range tests {
+		if code, msg := tt.o.Status(); code != tt.code || msg != tt.msg {
+			t.Errorf("%s: got %d %q", tt.name, code, msg)
+		}
+	}
+}
+
+func TestIANA(t *testing.T) {
+	ia := &IANA{IAID: 0x0a000005, T1: 30 * time.Minute, T2: Infinity}
+	ia.SetAddr(&IAAddr{
+		IP:        net.ParseIP("2001:db8::104"),
+		Preferred: time.Hour,
+		Valid:     2 * time.Hour,
+		Options:   Options{OptionStatusCode: {0, 0}},
+	})
+	o := Options{}
+	o.SetIANA(ia)
+
+	got, err := o.IANA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IAID != ia.IAID || got.T1 != ia.T1 || got.T2 != Infinity {
+		t.Errorf("association read back as %+v", got)
+	}
+	a, err := got.Addr()
+	if err != nil || a == nil {
+		t.Fatalf("address read back as %v, %v", a, err)
+	}
+	if !a.IP.Equal(net.ParseIP("2001:db8::104")) || a.Preferred != time.Hour || a.Valid != 2*time.Hour {
+		t.Errorf("address read back as %+v", a)
+	}
+	if code, _ := a.Options.Status(); code != StatusSuccess || len(a.Options) != 1 {
+		t.Errorf("address options read back as %v", a.Options)
+	}
+
+	if ia, err := (Options{}).IANA(); ia != nil || err != nil {
+		t.Errorf("missing association read as %v, %v", ia, err)
+	}
+	if _, err := (Options{OptionIANA: make([]byte, 11)}).IANA(); err != ErrBadOptionLen {
+		t.Errorf("short association: %v", err)
+	}
+	empty := &IANA{Options: Options{OptionIAAddr: make([]byte, 23)}}
+	if _, err := empty.Addr(); err != ErrBadOptionLen {
+		t.Errorf("short address: %v", err)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	tests := []struct {
+		name string
+		v    []byte
+		want []string
+		err  error
+	}{
+		{"none", nil, nil, nil},
+		{"two", []byte("\x07example\x03com\x00\x03eng\x07example\x03com\x00"), []string{"example.com", "eng.example.com"}, nil},
+		{"label past the end", []byte("\x07exam"), nil, ErrBadOptionLen},
+	}
+	for _, tt := range tests {
+		got, err := (Options{OptionDomainList: tt.v}).Domains()
+		if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestIPs(t *testing.T) {
+	v := append(net.ParseIP("2001:db8::53").To16(), net.ParseIP("2001:db8::54").To16()...)
+	// Trailing bytes short of an address are ignored
+	o := Options{OptionDNSServers: append(v, 1, 2)}
+	ips := o.IPs(OptionDNSServers)
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("2001:db8::53")) || !ips[1].Equal(net.ParseIP("2001:db8::54")) {
+		t.Errorf("read %v", ips)
+	}
+}
@@ -0,0 +1,106 @@
+// Package dhcp6 implements encoding and decoding of DHCPv6 messages
+// (RFC 3315) as they are exchanged by polyp on behalf of containers.
+package dhcp6
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+type MessageType byte
+
+const (
+	Solicit MessageType = iota + 1
+	Advertise
+	Request
+	Confirm
+	Renew
+	Rebind
+	Reply
+	Release
+	Decline
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case Solicit:
+		return "SOLICIT"
+	case Advertise:
+		return "ADVERTISE"
+	case Request:
+		return "REQUEST"
+	case Confirm:
+		return "CONFIRM"
+	case Renew:
+		return "RENEW"
+	case Rebind:
+		return "REBIND"
+	case Reply:
+		return "REPLY"
+	case Release:
+		return "RELEASE"
+	case Decline:
+		return "DECLINE"
+	}
+	return fmt.Sprintf("DHCPV6(%d)", byte(t))
+}
+
+const (
+	ClientPort = 546
+	ServerPort = 547
+)
+
+// AllServers is the multicast group of DHCPv6 relays and servers on a link
+var AllServers = net.ParseIP("ff02::1:2")
+
+var (
+	ErrShortPacket  = errors.New("dhcp6: packet too short")
+	ErrBadOptionLen = errors.New("dhcp6: option exceeds packet length")
+)
+
+// Packet is a single client/server DHCPv6 message
+type Packet struct {
+	Type MessageType
+	// Transaction ID, only the low 24 bits are used
+	XID     uint32
+	Options Options
+}
+
+func NewPacket(t MessageType, xid uint32) *Packet {
+	return &Packet{
+		Type:    t,
+		XID:     xid & 0xffffff,
+		Options: make(Options),
+	}
+}
+
+func (p *Packet) String() string {
+	return fmt.Sprintf("%v xid=%06x", p.Type, p.XID)
+}
+
+// Marshal encodes the packet into its wire format
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, p.XID)
+	b[0] = byte(p.Type)
+	return p.Options.marshal(b)
+}
+
+// Unmarshal decodes a packet from its wire format, relay messages are not
+// understood
+func Unmarshal(b []byte) (*Packet, error) {
+	if len(b) < 4 {
+		return nil, ErrShortPacket
+	}
+	p := &Packet{
+		Type: MessageType(b[0]),
+		XID:  binary.BigEndian.Uint32(b[0:4]) & 0xffffff,
+	}
+	var err error
+	if p.Options, err = unmarshalOptions(b[4:]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,84 @@
+package dhcp6
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:0a:00:00:05")
+	solicit := NewPacket(Solicit, 0xff123456)
+	solicit.Options[OptionClientID] = DUIDLL(mac)
+	solicit.Options.SetRequestList(OptionDNSServers, OptionDomainList)
+	solicit.Options.SetElapsedTime(1500 * time.Millisecond)
+	solicit.Options.SetIANA(&IANA{IAID: 5})
+
+	reply := NewPacket(Reply, 0xabcdef)
+	reply.Options[OptionServerID] = []byte{0, 1, 0, 1, 1, 2, 3, 4}
+	reply.Options[OptionDNSServers] = net.ParseIP("2001:db8::53")
+	ia := &IANA{IAID: 5, T1: time.Hour, T2: 2 * time.Hour}
+	ia.SetAddr(&IAAddr{IP: net.ParseIP("2001:db8::104"), Preferred: 3 * time.Hour, Valid: Infinity})
+	reply.Options.SetIANA(ia)
+
+	for _, p := range []*Packet{solicit, reply} {
+		got, err := Unmarshal(p.Marshal())
+		if err != nil {
+			t.Errorf("%v: %v", p, err)
+		} else if !reflect.DeepEqual(got, p) {
+			t.Errorf("%v: read back as %+v, want %+v", p, got, p)
+		}
+	}
+	if solicit.XID != 0x123456 {
+		t.Errorf("transaction ID %x kept more than 24 bits", solicit.XID)
+	}
+	if v := solicit.Options[OptionElapsedTime]; !bytes.Equal(v, []byte{0, 150}) {
+		t.Errorf("elapsed time %v", v)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"empty", nil, ErrShortPacket},
+		{"short header", []byte{byte(Reply), 0, 0}, ErrShortPacket},
+		{"short option header", []byte{byte(Reply), 0, 0, 1, 0, 1, 0}, ErrBadOptionLen},
+		{"option past the end", []byte{byte(Reply), 0, 0, 1, 0, 1, 0, 4, 1, 2}, ErrBadOptionLen},
+	}
+	for _, tt := range tests {
+		if _, err := Unmarshal(tt.b); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestEncapsulate(t *testing.T) {
+	payload := []byte("dhcpv6")
+	src := net.ParseIP("fe80::42:aff:fe00:5")
+	b := Encapsulate(payload, src, AllServers, ClientPort, ServerPort)
+	// The sum over a datagram carrying its checksum comes out as 0
+	if sum := checksum(b[8:40], b[ipv6HeaderLen:]); sum != 0 {
+		t.Errorf("bad UDP checksum, sums up to %04x", sum)
+	}
+
+	got, from, to, ok := Decapsulate(b, ServerPort)
+	if !ok || !bytes.Equal(got, payload) || !from.Equal(src) || !to.Equal(AllServers) {
+		t.Errorf("decapsulated %q from %v to %v, %v", got, from, to, ok)
+	}
+	if _, _, _, ok := Decapsulate(b, ClientPort); ok {
+		t.Error("decapsulated a packet to another port")
+	}
+	if _, _, _, ok := Decapsulate(b[:ipv6HeaderLen+4], ServerPort); ok {
+		t.Error("decapsulated a truncated packet")
+	}
+	ext := append([]byte(nil), b...)
+	ext[6] = 0 // hop-by-hop options header
+	if _, _, _, ok := Decapsulate(ext, ServerPort); ok {
+		t.Error("decapsulated a packet with extension headers")
+	}
+}
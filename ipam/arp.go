@@ -0,0 +1,121 @@
+package ipamplugin
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+	"github.com/xytis/arp"
+)
+
+// RFC 5227 2.1.1 timing
+const (
+	probeWait    = 1 * time.Second
+	probeNum     = 3
+	probeMin     = 1 * time.Second
+	probeMax     = 2 * time.Second
+	announceWait = 2 * time.Second
+)
+
+// arpProbe checks whether ip is in use on the segment of ifi before mac
+// takes it (RFC 5227 2.1). It returns the hardware address of the host
+// holding ip, or nil when nobody claimed it. Probing fails when deadline
+// passes first.
+//
+// arp.Client listens for ARP frames only, which are not delivered to
+// sockets on bridge ports, so frames are tapped the way rawConn does.
+func arpProbe(ifi *net.Interface, ip net.IP, mac net.HardwareAddr, deadline time.Time) (net.HardwareAddr, error) {
+	pc, err := raw.ListenPacket(ifi, raw.Protocol(syscall.ETH_P_ALL))
+	if err != nil {
+		return nil, fmt.Errorf("could not open packet socket on %s: %v", ifi.Name, err)
+	}
+	defer pc.Close()
+
+	// Sender address is left unspecified so that nobody updates its cache
+	probe, err := arp.NewPacket(arp.OperationRequest, mac, net.IPv4zero, ethernet.Broadcast, ip)
+	if err != nil {
+		return nil, err
+	}
+	pb, err := probe.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	fb, err := (&ethernet.Frame{
+		Destination: ethernet.Broadcast,
+		Source:      mac,
+		EtherType:   ethernet.EtherTypeARP,
+		Payload:     pb,
+	}).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	wait := time.Now().Add(jitter(0, probeWait))
+	for i := 0; i <= probeNum; i++ {
+		if wait.After(deadline) {
+			if hw, err := arpListen(pc, ip, mac, deadline); hw != nil || err != nil {
+				return hw, err
+			}
+			return nil, fmt.Errorf("probing cut short by the request timeout")
+		}
+		if hw, err := arpListen(pc, ip, mac, wait); hw != nil || err != nil {
+			return hw, err
+		}
+		switch {
+		case i < probeNum-1:
+			wait = time.Now().Add(jitter(probeMin, probeMax))
+		case i == probeNum-1:
+			wait = time.Now().Add(announceWait)
+		default:
+			return nil, nil
+		}
+		if _, err := pc.WriteTo(fb, &raw.Addr{HardwareAddr: ethernet.Broadcast}); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// arpListen waits until deadline for ARP packets showing ip taken by someone
+// other than mac, either as its sender or as the target of another probe
+func arpListen(pc net.PacketConn, ip net.IP, mac net.HardwareAddr, deadline time.Time) (net.HardwareAddr, error) {
+	if err := pc.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 128)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var (
+			f ethernet.Frame
+			p arp.Packet
+		)
+		if f.UnmarshalBinary(buf[:n]) != nil || f.EtherType != ethernet.EtherTypeARP {
+			continue
+		}
+		if p.UnmarshalBinary(f.Payload) != nil || bytes.Equal(p.SenderHardwareAddr, mac) {
+			continue
+		}
+		if p.SenderIP.Equal(ip) {
+			return p.SenderHardwareAddr, nil
+		}
+		if p.Operation == arp.OperationRequest && p.SenderIP.Equal(net.IPv4zero) && p.TargetIP.Equal(ip) {
+			return p.SenderHardwareAddr, nil
+		}
+	}
+}
+
+// jitter returns a random duration in [min, max)
+func jitter(min, max time.Duration) time.Duration {
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
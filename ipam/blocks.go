@@ -0,0 +1,306 @@
+package ipamplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/docker/libkv/store"
+	. "github.com/xytis/polyp/common"
+)
+
+func _blocks(subnet *net.IPNet) string {
+	return "polyp/block/" + url.QueryEscape(subnet.String())
+}
+
+func _block(subnet, b *net.IPNet) string {
+	return _blocks(subnet) + "/" + url.QueryEscape(b.String())
+}
+
+// block is a slice of a pool range owned by this host
+type block struct {
+	Net  *net.IPNet
+	used map[string]bool
+}
+
+// blocks keeps the address blocks this host claimed from static pools
+// with block affinity. Blocks are claimed in the shared store, addresses
+// within them are picked locally and recorded with Claim like any other, so
+// that gateways and auxiliary addresses do not land on them.
+type blocks struct {
+	sync.Mutex
+	// Owned blocks by subnet, then by block
+	owned map[string]map[string]*block
+	// Addresses known to be claimed by others, such as gateway and
+	// auxiliary addresses, by subnet
+	reserved map[string]map[string]bool
+}
+
+func blocksNew() *blocks {
+	return &blocks{
+		owned:    make(map[string]map[string]*block),
+		reserved: make(map[string]map[string]bool),
+	}
+}
+
+// blockAssign takes want, or any address, from a block of p owned by this
+// host for owner, claiming a new block when those are full
+func (sp *space) blockAssign(p *pool, want net.IP, owner string) (net.IP, error) {
+	bs := sp.blocks
+	bs.Lock()
+	defer bs.Unlock()
+	owned, err := sp.ownedBlocks(p)
+	if err != nil {
+		return nil, err
+	}
+	if want != nil {
+		if !p.Range.Contains(want) {
+			// Outside of any block, reserve it on its own
+			return sp.claim(p, p.Subnet, want, owner)
+		}
+		bn := blockOf(want, p.Block)
+		b := owned[bn.String()]
+		if b == nil {
+			if b, err = sp.claimBlock(p, bn); err != nil {
+				return nil, err
+			} else if b == nil {
+				// Whether the owner uses it is known only to the owner
+				owner := "another host"
+				if pair, err := sp.store.Get(_block(p.Subnet, bn)); err == nil {
+					owner = string(pair.Value)
+				}
+				return nil, ErrAddressRefused{want.String(), "its block " + bn.String() + " belongs to " + owner}
+			}
+		}
+		if b.used[want.String()] {
+			return nil, ErrAddressInUse(want.String())
+		}
+		if ok, err := sp.blockClaim(p, b, want, owner); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrAddressInUse(want.String())
+		}
+		return want, nil
+	}
+	keys := make([]string, 0, len(owned))
+	for k := range owned {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if ip, err := sp.free(p, owned[k], owner); ip != nil || err != nil {
+			return ip, err
+		}
+	}
+	taken, err := sp.takenBlocks(p.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	for _, bn := range split(p.Range, p.Block) {
+		if taken[bn.String()] {
+			continue
+		}
+		b, err := sp.claimBlock(p, bn)
+		if err != nil {
+			return nil, err
+		} else if b == nil {
+			// Someone was faster
+			continue
+		}
+		if ip, err := sp.free(p, b, owner); ip != nil || err != nil {
+			return ip, err
+		}
+	}
+	return nil, ErrPoolExhausted(p.Range.String())
+}
+
+// blockFree returns ip to its block, and the block to the pool once empty
+func (sp *space) blockFree(p *pool, ip net.IP) error {
+	bs := sp.blocks
+	bs.Lock()
+	defer bs.Unlock()
+	owned, err := sp.ownedBlocks(p)
+	if err != nil {
+		return err
+	}
+	if err := sp.unclaim(p.Subnet, ip); err != nil {
+		return err
+	}
+	// Read along with the claims of others
+	delete(bs.reserved[p.Subnet.String()], ip.String())
+	b := owned[blockOf(ip, p.Block).String()]
+	if b == nil || !b.used[ip.String()] {
+		return nil
+	}
+	delete(b.used, ip.String())
+	if len(b.used) > 0 {
+		return nil
+	}
+	key := _block(p.Subnet, b.Net)
+	pair, err := sp.store.Get(key)
+	if err != nil {
+		return fmt.Errorf("could not read block %v: %v", b.Net, err)
+	}
+	if string(pair.Value) != sp.leases.host {
+		Log.Warnf("Block %v of %v is held by %s, forgetting it", b.Net, p.Subnet, pair.Value)
+	} else if _, err := sp.store.AtomicDelete(key, pair); err != nil {
+		return fmt.Errorf("could not give back block %v: %v", b.Net, err)
+	}
+	delete(owned, b.Net.String())
+	Log.Infof("Gave back empty block %v of %v", b.Net, p.Subnet)
+	return nil
+}
+
+// loadBlocks looks up the blocks of p this host owns, unless done before.
+// Addresses count as used by the leases held at that time, so a lease is
+// only removed once the blocks of its pool are loaded.
+func (sp *space) loadBlocks(p *pool) error {
+	if p == nil || p.Block == 0 {
+		return nil
+	}
+	bs := sp.blocks
+	bs.Lock()
+	defer bs.Unlock()
+	_, err := sp.ownedBlocks(p)
+	return err
+}
+
+// ownedBlocks returns the blocks of the subnet of p this host owns. They
+// are looked up in the store once, and filled with leases held already.
+func (sp *space) ownedBlocks(p *pool) (map[string]*block, error) {
+	bs := sp.blocks
+	subnet := p.Subnet.String()
+	if owned, ok := bs.owned[subnet]; ok {
+		return owned, nil
+	}
+	pairs, err := sp.store.List(_blocks(p.Subnet))
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, fmt.Errorf("could not list blocks of %v: %v", p.Subnet, err)
+	}
+	owned := map[string]*block{}
+	for _, pair := range pairs {
+		if string(pair.Value) != sp.leases.host {
+			continue
+		}
+		k, err := url.QueryUnescape(path.Base(pair.Key))
+		if err != nil {
+			continue
+		}
+		if _, bn, err := net.ParseCIDR(k); err == nil {
+			owned[bn.String()] = &block{bn, map[string]bool{}}
+		}
+	}
+	for _, l := range sp.leases.list() {
+		if b := owned[blockOf(l.IP, p.Block).String()]; b != nil && l.State == leaseStatic {
+			b.used[l.IP.String()] = true
+		}
+	}
+	if bs.reserved[subnet], err = claimed(sp.store, p.Subnet); err != nil {
+		return nil, err
+	}
+	bs.owned[subnet] = owned
+	return owned, nil
+}
+
+// takenBlocks returns the set of blocks of subnet owned by any host
+func (sp *space) takenBlocks(subnet *net.IPNet) (map[string]bool, error) {
+	taken := map[string]bool{}
+	pairs, err := sp.store.List(_blocks(subnet))
+	if err == store.ErrKeyNotFound {
+		return taken, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not list blocks of %v: %v", subnet, err)
+	}
+	for _, pair := range pairs {
+		if k, err := url.QueryUnescape(path.Base(pair.Key)); err == nil {
+			taken[k] = true
+		}
+	}
+	return taken, nil
+}
+
+// claimBlock takes bn for this host, returning nil when another host owns
+// it. The gateway and auxiliary addresses are looked up again, as they
+// may have been reserved since.
+func (sp *space) claimBlock(p *pool, bn *net.IPNet) (*block, error) {
+	ok, _, err := sp.store.AtomicPut(_block(p.Subnet, bn), []byte(sp.leases.host), nil, nil)
+	if err == store.ErrKeyExists || (err == nil && !ok) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not claim block %v: %v", bn, err)
+	}
+	reserved, err := claimed(sp.store, p.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	sp.blocks.reserved[p.Subnet.String()] = reserved
+	b := &block{bn, map[string]bool{}}
+	sp.blocks.owned[p.Subnet.String()][bn.String()] = b
+	Log.Infof("Claimed block %v of %v", bn, p.Subnet)
+	return b, nil
+}
+
+// free takes the first unused address of b allowed in p for owner, or
+// returns nil
+func (sp *space) free(p *pool, b *block, owner string) (net.IP, error) {
+	hs := hosts(p.Subnet, b.Net)
+	for ip := hs.next(); ip != nil; ip = hs.next() {
+		if b.used[ip.String()] || !p.allowed(ip) {
+			continue
+		}
+		if ok, err := sp.blockClaim(p, b, ip, owner); err != nil {
+			return nil, err
+		} else if ok {
+			return ip, nil
+		}
+	}
+	return nil, nil
+}
+
+// blockClaim records ip of b as taken by owner, reporting false when it is
+// claimed already, as gateways and auxiliary addresses are. Those known
+// from earlier attempts are skipped without asking the store.
+func (sp *space) blockClaim(p *pool, b *block, ip net.IP, owner string) (bool, error) {
+	reserved := sp.blocks.reserved[p.Subnet.String()]
+	if reserved[ip.String()] {
+		return false, nil
+	}
+	if _, err := sp.claim(p, p.Subnet, ip, owner); err != nil {
+		if _, ok := err.(ErrAddressInUse); ok {
+			reserved[ip.String()] = true
+			return false, nil
+		}
+		return false, err
+	}
+	b.used[ip.String()] = true
+	return true, nil
+}
+
+// split tiles r into blocks of the given prefix length
+func split(r *net.IPNet, prefix int) []*net.IPNet {
+	ones, bits := r.Mask.Size()
+	if prefix < ones || bits != 32 {
+		return []*net.IPNet{r}
+	}
+	var (
+		res  []*net.IPNet
+		base = binary.BigEndian.Uint32(r.IP.To4().Mask(r.Mask))
+		step = uint32(1) << uint(32-prefix)
+	)
+	for k := uint32(0); k < 1<<uint(prefix-ones); k++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+k*step)
+		res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, 32)})
+	}
+	return res
+}
+
+// blockOf returns the block of the given prefix length ip falls into
+func blockOf(ip net.IP, prefix int) *net.IPNet {
+	mask := net.CIDRMask(prefix, 32)
+	return &net.IPNet{IP: ip.To4().Mask(mask), Mask: mask}
+}
@@ -0,0 +1,128 @@
+package ipamplugin
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	ipamapi "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libkv/store"
+	"github.com/docker/libnetwork/netlabel"
+	. "github.com/xytis/polyp/common"
+)
+
+// newTestStaticIpam returns an ipam keeping its local space in st, with
+// the leases held there loaded as at startup
+func newTestStaticIpam(t *testing.T, st store.Store) *ipam {
+	c := newClient("lo", nil, timing{})
+	sp := spaceNew(LocalSpace, c, nil, "host1", st)
+	if err := sp.leases.load(); err != nil {
+		t.Fatal(err)
+	}
+	return &ipam{
+		client: c,
+		spaces: map[string]*space{LocalSpace: sp},
+	}
+}
+
+func TestBlockAddresses(t *testing.T) {
+	st, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	i := newTestStaticIpam(t, st)
+	pool, err := i.RequestPool(&ipamapi.RequestPoolRequest{
+		AddressSpace: LocalSpace,
+		Pool:         "10.1.0.0/24",
+		SubPool:      "10.1.0.0/28",
+		Options:      map[string]string{optMode: modeStatic, optBlock: "30"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.RequestAddress(&ipamapi.RequestAddressRequest{
+		PoolID:  pool.PoolID,
+		Address: "10.1.0.1",
+		Options: map[string]string{requestAddressType: netlabel.Gateway},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := i.RequestAddress(&ipamapi.RequestAddressRequest{
+		PoolID:  pool.PoolID,
+		Options: map[string]string{netlabel.MacAddress: "02:00:00:00:00:01"},
+	})
+	if err != nil || res.Address != "10.1.0.2/24" {
+		t.Fatalf("got %v, %v", res, err)
+	}
+
+	// Block addresses are claimed like others
+	_, err = i.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: pool.PoolID, Address: "10.1.0.2"})
+	if err != ErrAddressInUse("10.1.0.2") {
+		t.Errorf("auxiliary address on a block address: %v", err)
+	}
+
+	// The block goes back once empty, even after a restart
+	subnet, bn := mustCIDR(t, "10.1.0.0/24"), mustCIDR(t, "10.1.0.0/30")
+	if _, err := st.Get(_block(subnet, bn)); err != nil {
+		t.Fatalf("block %v not claimed: %v", bn, err)
+	}
+	i = newTestStaticIpam(t, st)
+	if err := i.ReleaseAddress(&ipamapi.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "10.1.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Get(_block(subnet, bn)); err != store.ErrKeyNotFound {
+		t.Errorf("block %v kept: %v", bn, err)
+	}
+	if _, err := st.Get(_address(subnet, mustCIDR(t, "10.1.0.2/32").IP)); err != store.ErrKeyNotFound {
+		t.Errorf("address 10.1.0.2 kept: %v", err)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		r      *net.IPNet
+		prefix int
+		want   []string
+	}{
+		{mustCIDR(t, "10.1.0.0/28"), 30, []string{"10.1.0.0/30", "10.1.0.4/30", "10.1.0.8/30", "10.1.0.12/30"}},
+		{mustCIDR(t, "10.1.0.0/28"), 28, []string{"10.1.0.0/28"}},
+		{mustCIDR(t, "10.1.0.128/25"), 26, []string{"10.1.0.128/26", "10.1.0.192/26"}},
+		// Across an octet boundary
+		{mustCIDR(t, "10.1.0.0/23"), 24, []string{"10.1.0.0/24", "10.1.1.0/24"}},
+		// Blocks larger than the range leave it whole
+		{mustCIDR(t, "10.1.0.16/29"), 28, []string{"10.1.0.16/29"}},
+		// Ranges given by an address within them
+		{&net.IPNet{IP: net.ParseIP("10.1.0.5"), Mask: net.CIDRMask(28, 32)}, 29, []string{"10.1.0.0/29", "10.1.0.8/29"}},
+		{&net.IPNet{IP: net.ParseIP("10.1.0.77").To4(), Mask: net.CIDRMask(26, 32)}, 27, []string{"10.1.0.64/27", "10.1.0.96/27"}},
+		{mustCIDR(t, "2001:db8::/64"), 80, []string{"2001:db8::/64"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, b := range split(tt.r, tt.prefix) {
+			got = append(got, b.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("split(%v, %d) = %v, want %v", tt.r, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestBlockOf(t *testing.T) {
+	tests := []struct {
+		ip     string
+		prefix int
+		want   string
+	}{
+		{"10.1.0.5", 30, "10.1.0.4/30"},
+		{"10.1.0.4", 30, "10.1.0.4/30"},
+		{"10.1.0.7", 30, "10.1.0.4/30"},
+		{"10.1.0.8", 30, "10.1.0.8/30"},
+		{"10.1.0.200", 26, "10.1.0.192/26"},
+		{"10.1.1.3", 23, "10.1.0.0/23"},
+		{"10.1.0.9", 32, "10.1.0.9/32"},
+	}
+	for _, tt := range tests {
+		if got := blockOf(net.ParseIP(tt.ip), tt.prefix).String(); got != tt.want {
+			t.Errorf("blockOf(%s, %d) = %s, want %s", tt.ip, tt.prefix, got, tt.want)
+		}
+	}
+}
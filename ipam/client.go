@@ -0,0 +1,537 @@
+package ipamplugin
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/xytis/polyp/common"
+	"github.com/xytis/polyp/dhcp"
+)
+
+const (
+	// Offers of addresses found in use before giving up
+	maxDeclines = 3
+	// Longest wait between retransmits (RFC 2131 4.1)
+	maxRetransmitInterval = 64 * time.Second
+)
+
+// timing controls how DHCP messages are retransmitted
+type timing struct {
+	// Wait before the first retransmit
+	Retransmit time.Duration
+	// Factor the wait grows by after each retransmit
+	Backoff float64
+	// Time after which the exchange is given up
+	Timeout time.Duration
+}
+
+var defaultTiming = timing{
+	Retransmit: 2 * time.Second,
+	Backoff:    2,
+	Timeout:    10 * time.Second,
+}
+
+// deadline returns the time by which a request started now must be done,
+// be it a single exchange or several
+func (t timing) deadline() time.Time {
+	return time.Now().Add(t.Timeout)
+}
+
+// merge returns t with unset values taken from d
+func (t timing) merge(d timing) timing {
+	if t.Retransmit <= 0 {
+		t.Retransmit = d.Retransmit
+	}
+	if t.Backoff < 1 {
+		t.Backoff = d.Backoff
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = d.Timeout
+	}
+	return t
+}
+
+// Options we are interested in when asking for a lease
+var requestList = []dhcp.OptionCode{
+	dhcp.OptionSubnetMask,
+	dhcp.OptionRouter,
+	dhcp.OptionDomainNameServer,
+	dhcp.OptionDomainName,
+	dhcp.OptionIPAddressLeaseTime,
+	dhcp.OptionRenewalTime,
+	dhcp.OptionRebindingTime,
+	dhcp.OptionDomainSearch,
+	dhcp.OptionClasslessRoute,
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// client speaks DHCP on behalf of container MAC addresses. Exchanges of
+// different pools run side by side, the lock only guards turns and link
+// creation.
+type client struct {
+	sync.Mutex
+	iface string
+	// Server to relay to, nil to broadcast
+	server net.IP
+	timing timing
+	// Server hardware addresses learned on packet sockets
+	hwaddrs *hwaddrs
+	// Exchanges on sockets bound to the same address take turns, by address
+	turns map[string]*sync.Mutex
+	// Remote ID of the relay agent information sent along with every
+	// request, the host name by default
+	agentID string
+}
+
+func newClient(iface string, server net.IP, t timing) *client {
+	return &client{
+		iface:   iface,
+		server:  server,
+		timing:  t.merge(defaultTiming),
+		hwaddrs: &hwaddrs{m: make(map[string]net.HardwareAddr)},
+		turns:   make(map[string]*sync.Mutex),
+	}
+}
+
+// timingOf returns the timing used for p, which may be nil
+func (c *client) timingOf(p *pool) timing {
+	if p == nil {
+		return c.timing
+	}
+	return p.Timing.merge(c.timing)
+}
+
+// link returns the interface DHCP for p is spoken on, p may be nil
+func (c *client) link(p *pool) (*net.Interface, error) {
+	switch {
+	case p == nil:
+		return net.InterfaceByName(c.iface)
+	case p.Link != "":
+		c.Lock()
+		defer c.Unlock()
+		return poolLink(p, c.iface)
+	case p.Parent != "":
+		return net.InterfaceByName(p.Parent)
+	}
+	return net.InterfaceByName(c.iface)
+}
+
+// open binds to the link of p. Pools served by a known server are relayed
+// to it, pools bound to a link get a packet socket there, others a UDP
+// socket on the host interface.
+//
+// Replies unicast to a port reach only one of the sockets bound to it, so
+// exchanges through the relay port, or the client port of an interface,
+// wait for their turn. Packet sockets all see every frame.
+func (c *client) open(p *pool) (conn, error) {
+	var (
+		server = c.server
+		subnet *net.IPNet
+		ifi    *net.Interface
+		cn     conn
+		err    error
+	)
+	if p != nil {
+		subnet = p.Subnet
+		if p.Server != nil {
+			server = p.Server
+		}
+	}
+	if server == nil {
+		if ifi, err = c.link(p); err != nil {
+			return nil, err
+		}
+	}
+	var turn *sync.Mutex
+	if server != nil {
+		turn = c.turn("relay")
+	} else if p == nil || p.Link == "" {
+		turn = c.turn("udp:" + ifi.Name)
+	}
+	if turn != nil {
+		turn.Lock()
+	}
+
+	if server != nil {
+		cn, err = listenRelay(server, subnet)
+	} else if p != nil && p.Link != "" {
+		cn, err = listenRaw(ifi, c.hwaddrs)
+	} else {
+		cn, err = listenUDP(ifi.Name, dhcp.ClientPort)
+	}
+	if err != nil {
+		if turn != nil {
+			turn.Unlock()
+		}
+		return nil, err
+	}
+	cn = &agentConn{cn, c.circuitID(p), c.agentID}
+	if turn != nil {
+		cn = &turnConn{cn, turn}
+	}
+	return cn, nil
+}
+
+// turn returns the lock exchanges on sockets bound to addr take turns on
+func (c *client) turn(addr string) *sync.Mutex {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.turns[addr]; !ok {
+		c.turns[addr] = &sync.Mutex{}
+	}
+	return c.turns[addr]
+}
+
+// circuitID names the VLAN, or else the link, and the network of p as
+// <vlan|link>:<network>. The network is the docker network created on the
+// pool, or before there is one the name given by option, or the pool ID.
+func (c *client) circuitID(p *pool) string {
+	if p == nil {
+		return c.iface
+	}
+	link := p.Link
+	switch {
+	case p.Vlan != 0:
+		link = "vlan" + strconv.Itoa(p.Vlan)
+	case link == "" && p.Parent != "":
+		link = p.Parent
+	case link == "":
+		link = c.iface
+	}
+	network := p.NetworkID
+	if network == "" {
+		network = p.Network
+	}
+	if network == "" {
+		network = p.ID
+	}
+	if network == "" {
+		return link
+	}
+	return link + ":" + network
+}
+
+// identity is what a container is known as to DHCP servers, apart from
+// its MAC address which changes with every restart
+type identity struct {
+	ClientID string
+	Hostname string
+}
+
+// set adds client identifier (RFC 2132 9.14) and hostname options to p.
+// The identifier is sent with type 0, as it is not a hardware address.
+func (id identity) set(p *dhcp.Packet) {
+	if id.ClientID != "" {
+		p.Options[dhcp.OptionClientIdentifier] = append([]byte{0}, id.ClientID...)
+	}
+	if t := p.Type(); id.Hostname != "" && t != dhcp.Release && t != dhcp.Decline {
+		p.Options[dhcp.OptionHostName] = []byte(id.Hostname)
+	}
+}
+
+// packet prepares a client message. Replies are always requested as
+// broadcasts, since they are addressed to a container we are not.
+func (c *client) packet(t dhcp.MessageType, xid uint32, mac net.HardwareAddr) *dhcp.Packet {
+	p := dhcp.NewPacket(t, xid, mac)
+	p.Flags = dhcp.FlagBroadcast
+	p.Options.SetRequestList(requestList...)
+	return p
+}
+
+// acquire leases an address to mac, making sure nobody on the link uses
+// it already. Addresses found in use, and those p keeps from containers,
+// are declined and another is asked for, unless a specific address was
+// wanted. All of it has to be done by deadline.
+func (c *client) acquire(p *pool, mac net.HardwareAddr, id identity, want net.IP, deadline time.Time) (*lease, error) {
+	ifi, err := c.link(p)
+	if err != nil {
+		return nil, err
+	}
+	for declines := 0; ; declines++ {
+		l, err := c.bind(p, mac, id, want, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if want == nil && !p.allowed(l.IP) {
+			Log.Warnf("Address %v leased to %v is excluded or reserved in the pool, declining", l.IP, mac)
+			if err := c.decline(p, l); err != nil {
+				Log.Warnf("Could not decline %v: %v", l.IP, err)
+			}
+			if declines+1 >= maxDeclines {
+				return nil, fmt.Errorf("dhcp server offered only addresses excluded or reserved in pool %v", p.Subnet)
+			}
+			continue
+		}
+		hw, err := arpProbe(ifi, l.IP, mac, deadline)
+		if err != nil {
+			Log.Warnf("Could not probe %v on %s for conflicts: %v", l.IP, ifi.Name, err)
+			return l, nil
+		} else if hw == nil {
+			return l, nil
+		}
+		Log.Warnf("Address %v leased to %v is in use by %v, declining", l.IP, mac, hw)
+		if err := c.decline(p, l); err != nil {
+			Log.Warnf("Could not decline %v: %v", l.IP, err)
+		}
+		if want != nil || declines+1 >= maxDeclines {
+			return nil, ErrAddressConflict(l.IP.String())
+		}
+	}
+}
+
+// bind performs the DISCOVER/OFFER/REQUEST/ACK exchange for mac. A wanted
+// address is first asked for directly as in INIT-REBOOT state, servers
+// which keep no record of mac stay silent then and are asked to offer it.
+func (c *client) bind(p *pool, mac net.HardwareAddr, id identity, want net.IP, deadline time.Time) (*lease, error) {
+	cn, err := c.open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+	t := c.timingOf(p)
+
+	if want != nil {
+		// Silence is not worth the whole timeout here
+		quick := time.Now().Add(2 * t.Retransmit)
+		if quick.After(deadline) {
+			quick = deadline
+		}
+		request := c.packet(dhcp.Request, rand.Uint32(), mac)
+		request.Options.SetIP(dhcp.OptionRequestedIPAddress, want)
+		id.set(request)
+		ack, err := exchange(cn, request, net.IPv4bcast, dhcp.Ack, t, quick)
+		switch e := err.(type) {
+		case nil:
+			if !ack.YIAddr.Equal(want) {
+				return nil, ErrAddressRefused{want.String(), "dhcp server acknowledged " + ack.YIAddr.String() + " instead"}
+			}
+			Log.Debugf("Received %v", ack)
+			l := newLease(mac, ack, time.Now())
+			l.identity = id
+			return l, nil
+		case ErrDhcpNak:
+			return nil, refused(want, e)
+		case ErrDhcpTimeout:
+		default:
+			return nil, err
+		}
+	}
+
+	discover := c.packet(dhcp.Discover, rand.Uint32(), mac)
+	if want != nil {
+		discover.Options.SetIP(dhcp.OptionRequestedIPAddress, want)
+	}
+	id.set(discover)
+	offer, err := exchange(cn, discover, net.IPv4bcast, dhcp.Offer, t, deadline)
+	if err != nil {
+		return nil, err
+	}
+	Log.Debugf("Received %v", offer)
+	if want != nil && !offer.YIAddr.Equal(want) {
+		return nil, ErrAddressRefused{want.String(), "dhcp server offered " + offer.YIAddr.String() + " instead"}
+	}
+
+	request := c.packet(dhcp.Request, discover.XID, mac)
+	request.Options.SetIP(dhcp.OptionRequestedIPAddress, offer.YIAddr)
+	request.Options.SetIP(dhcp.OptionServerIdentifier, serverID(offer))
+	id.set(request)
+	ack, err := exchange(cn, request, net.IPv4bcast, dhcp.Ack, t, deadline)
+	if nak, ok := err.(ErrDhcpNak); ok && want != nil {
+		return nil, refused(want, nak)
+	} else if err != nil {
+		return nil, err
+	}
+	Log.Debugf("Received %v", ack)
+
+	l := newLease(mac, ack, time.Now())
+	l.identity = id
+	return l, nil
+}
+
+// refused names the wanted address in a NAK
+func refused(want net.IP, nak ErrDhcpNak) error {
+	reason := "dhcp server sent DHCPNAK"
+	if nak != "" {
+		reason += ": " + string(nak)
+	}
+	return ErrAddressRefused{want.String(), reason}
+}
+
+// probe asks DHCP servers what the network on the interface looks like.
+// A host having an address there sends DHCPINFORM, otherwise the offer
+// received for a DHCPDISCOVER is inspected and never taken.
+func (c *client) probe(p *pool) (*net.IPNet, net.IP, error) {
+	ifi, err := c.link(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	cn, err := c.open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cn.Close()
+
+	var (
+		ip    net.IP
+		reply *dhcp.Packet
+		t     = c.timingOf(p)
+	)
+	if ip = interfaceIPv4(ifi); ip != nil {
+		inform := c.packet(dhcp.Inform, rand.Uint32(), ifi.HardwareAddr)
+		inform.CIAddr = ip
+		reply, err = exchange(cn, inform, net.IPv4bcast, dhcp.Ack, t, t.deadline())
+	} else {
+		discover := c.packet(dhcp.Discover, rand.Uint32(), ifi.HardwareAddr)
+		if reply, err = exchange(cn, discover, net.IPv4bcast, dhcp.Offer, t, t.deadline()); err == nil {
+			ip = reply.YIAddr
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	Log.Debugf("Received %v", reply)
+	mask := reply.Options.Mask()
+	if mask == nil {
+		return nil, nil, fmt.Errorf("dhcp server %v did not send a subnet mask", serverID(reply))
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, reply.Options.IP(dhcp.OptionRouter), nil
+}
+
+// extend asks for more time on l. While renewing dst is the server which
+// granted the lease, while rebinding it is the broadcast address.
+func (c *client) extend(p *pool, l *lease, dst net.IP) (*lease, error) {
+	cn, err := c.open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+
+	// A REQUEST carrying ciaddr would be answered to the container itself,
+	// so the address is asked for as in INIT-REBOOT state instead.
+	request := c.packet(dhcp.Request, rand.Uint32(), l.MAC)
+	request.Options.SetIP(dhcp.OptionRequestedIPAddress, l.IP)
+	l.identity.set(request)
+	t := c.timingOf(p)
+	ack, err := exchange(cn, request, dst, dhcp.Ack, t, t.deadline())
+	if err != nil {
+		return nil, err
+	}
+	if !ack.YIAddr.Equal(l.IP) {
+		return nil, fmt.Errorf("dhcp server acknowledged %v instead of %v", ack.YIAddr, l.IP)
+	}
+	Log.Debugf("Received %v", ack)
+
+	fresh := newLease(l.MAC, ack, time.Now())
+	fresh.Pool = l.Pool
+	fresh.identity = l.identity
+	return fresh, nil
+}
+
+// release gives l back to its server. Servers do not answer releases.
+func (c *client) release(p *pool, l *lease) error {
+	cn, err := c.open(p)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+
+	dst := l.Server
+	if dst == nil || dst.IsUnspecified() {
+		dst = net.IPv4bcast
+	}
+	release := dhcp.NewPacket(dhcp.Release, rand.Uint32(), l.MAC)
+	release.CIAddr = l.IP
+	release.Options.SetIP(dhcp.OptionServerIdentifier, l.Server)
+	l.identity.set(release)
+	Log.Debugf("Sending %v to %v", release, dst)
+	return cn.Send(release, dst)
+}
+
+// decline tells the server of l that its address is in use. As with
+// releases, no answer is expected.
+func (c *client) decline(p *pool, l *lease) error {
+	cn, err := c.open(p)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+
+	decline := dhcp.NewPacket(dhcp.Decline, rand.Uint32(), l.MAC)
+	decline.Options.SetIP(dhcp.OptionRequestedIPAddress, l.IP)
+	decline.Options.SetIP(dhcp.OptionServerIdentifier, l.Server)
+	l.identity.set(decline)
+	Log.Debugf("Sending %v", decline)
+	return cn.Send(decline, net.IPv4bcast)
+}
+
+// exchange sends rq until a reply of type want arrives. Retransmits
+// happen after t.Retransmit, growing by t.Backoff, until deadline passes.
+func exchange(cn conn, rq *dhcp.Packet, dst net.IP, want dhcp.MessageType, t timing, deadline time.Time) (*dhcp.Packet, error) {
+	for interval := t.Retransmit; time.Now().Before(deadline); interval = backoff(interval, t.Backoff) {
+		Log.Debugf("Sending %v to %v", rq, dst)
+		if err := cn.Send(rq, dst); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(interval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		for {
+			p, err := cn.Receive(wait)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if p.Op != dhcp.BootReply || p.XID != rq.XID || !bytes.Equal(p.CHAddr, rq.CHAddr) {
+				continue
+			}
+			switch p.Type() {
+			case want:
+				return p, nil
+			case dhcp.Nak:
+				return nil, ErrDhcpNak(p.Options.String(dhcp.OptionMessage))
+			}
+		}
+	}
+	return nil, ErrDhcpTimeout(want.String())
+}
+
+func backoff(interval time.Duration, factor float64) time.Duration {
+	interval = time.Duration(float64(interval) * factor)
+	if interval > maxRetransmitInterval {
+		interval = maxRetransmitInterval
+	}
+	return interval
+}
+
+// serverID returns the address identifying the server which sent p
+func serverID(p *dhcp.Packet) net.IP {
+	if id := p.Options.IP(dhcp.OptionServerIdentifier); id != nil {
+		return id
+	}
+	return p.SIAddr
+}
+
+// interfaceIPv4 returns the first IPv4 address of ifi, or nil
+func interfaceIPv4(ifi *net.Interface) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			return ipn.IP.To4()
+		}
+	}
+	return nil
+}
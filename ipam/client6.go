@@ -0,0 +1,247 @@
+package ipamplugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/xytis/polyp/common"
+	"github.com/xytis/polyp/dhcp6"
+)
+
+// Options we are interested in when asking for an IPv6 lease
+var requestList6 = []dhcp6.OptionCode{
+	dhcp6.OptionDNSServers,
+	dhcp6.OptionDomainList,
+}
+
+// duid identifies the container to DHCPv6 servers. Containers with a
+// client identifier keep their DUID across restarts, it is a UUID
+// (RFC 6355) derived from the identifier. Others get the link-layer DUID
+// of their MAC.
+func (id identity) duid(mac net.HardwareAddr) []byte {
+	if id.ClientID == "" {
+		return dhcp6.DUIDLL(mac)
+	}
+	sum := sha256.Sum256([]byte(id.ClientID))
+	return append([]byte{0, 4}, sum[:16]...)
+}
+
+// iaid names the single association of a container, derived from its MAC
+func iaid(mac net.HardwareAddr) uint32 {
+	if len(mac) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(mac[len(mac)-4:])
+}
+
+// packet6 prepares a client message for mac asking for the association
+// of addr, which may be nil
+func (c *client) packet6(t dhcp6.MessageType, mac net.HardwareAddr, id identity, addr net.IP) *dhcp6.Packet {
+	p := dhcp6.NewPacket(t, rand.Uint32())
+	p.Options[dhcp6.OptionClientID] = id.duid(mac)
+	p.Options.SetRequestList(requestList6...)
+	ia := &dhcp6.IANA{IAID: iaid(mac)}
+	if addr != nil {
+		ia.SetAddr(&dhcp6.IAAddr{IP: addr})
+	}
+	p.Options.SetIANA(ia)
+	return p
+}
+
+// open6 opens a packet socket on the link of p. Like those of IPv4, they
+// all see every frame, so exchanges need not take turns.
+func (c *client) open6(p *pool) (*raw6Conn, error) {
+	ifi, err := c.link(p)
+	if err != nil {
+		return nil, err
+	}
+	return listenRaw6(ifi)
+}
+
+// acquire6 leases an IPv6 address to mac in the SOLICIT, ADVERTISE,
+// REQUEST, REPLY exchange by deadline. want is passed on as a hint to the
+// server.
+func (c *client) acquire6(p *pool, mac net.HardwareAddr, id identity, want net.IP, deadline time.Time) (*lease, error) {
+	cn, err := c.open6(p)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+	t := c.timingOf(p)
+
+	solicit := c.packet6(dhcp6.Solicit, mac, id, want)
+	advertise, _, err := exchange6(cn, solicit, dhcp6.Advertise, t, deadline)
+	if err != nil {
+		return nil, err
+	}
+	offered, err := leaseAddr(p, advertise)
+	if err != nil {
+		return nil, err
+	}
+	if want != nil && !offered.Equal(want) {
+		return nil, ErrAddressRefused{want.String(), "dhcpv6 server offered " + offered.String() + " instead"}
+	}
+
+	request := c.packet6(dhcp6.Request, mac, id, offered)
+	request.Options[dhcp6.OptionServerID] = advertise.Options[dhcp6.OptionServerID]
+	reply, from, err := exchange6(cn, request, dhcp6.Reply, t, deadline)
+	if err != nil {
+		return nil, err
+	}
+	return newLease6(p, mac, id, reply, from, time.Now())
+}
+
+// extend6 renews l with the server which granted it, or rebinds it with
+// any server
+func (c *client) extend6(p *pool, l *lease, rebind bool) (*lease, error) {
+	cn, err := c.open6(p)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+
+	rq := c.packet6(dhcp6.Renew, l.MAC, l.identity, l.IP)
+	if rebind {
+		rq.Type = dhcp6.Rebind
+	} else {
+		rq.Options[dhcp6.OptionServerID] = l.ServerID
+	}
+	t := c.timingOf(p)
+	reply, from, err := exchange6(cn, rq, dhcp6.Reply, t, t.deadline())
+	if err != nil {
+		return nil, err
+	}
+	fresh, err := newLease6(p, l.MAC, l.identity, reply, from, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	fresh.Pool = l.Pool
+	return fresh, nil
+}
+
+// release6 gives l back to its server, the reply is not waited for
+func (c *client) release6(p *pool, l *lease) error {
+	cn, err := c.open6(p)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+
+	release := c.packet6(dhcp6.Release, l.MAC, l.identity, l.IP)
+	release.Options[dhcp6.OptionServerID] = l.ServerID
+	Log.Debugf("Sending %v", release)
+	return cn.Send(release)
+}
+
+// leaseAddr returns the address of the association in a server message,
+// or the error the server reported
+func leaseAddr(p *pool, m *dhcp6.Packet) (net.IP, error) {
+	if code, msg := m.Options.Status(); code != dhcp6.StatusSuccess {
+		return nil, statusError(p, code, msg)
+	}
+	ia, err := m.Options.IANA()
+	if err != nil {
+		return nil, err
+	} else if ia == nil {
+		return nil, ErrDhcp6Status{dhcp6.StatusNoAddrsAvail, "no address association in " + m.Type.String()}
+	}
+	if code, msg := ia.Options.Status(); code != dhcp6.StatusSuccess {
+		return nil, statusError(p, code, msg)
+	}
+	a, err := ia.Addr()
+	if err != nil {
+		return nil, err
+	} else if a == nil {
+		return nil, ErrDhcp6Status{dhcp6.StatusNoAddrsAvail, "no address in " + m.Type.String()}
+	}
+	return a.IP, nil
+}
+
+func statusError(p *pool, code uint16, msg string) error {
+	if code == dhcp6.StatusNoAddrsAvail && p != nil {
+		return ErrPoolExhausted(p.Subnet.String())
+	}
+	return ErrDhcp6Status{code, msg}
+}
+
+func newLease6(p *pool, mac net.HardwareAddr, id identity, reply *dhcp6.Packet, from net.IP, now time.Time) (*lease, error) {
+	ip, err := leaseAddr(p, reply)
+	if err != nil {
+		return nil, err
+	}
+	ia, _ := reply.Options.IANA()
+	a, _ := ia.Addr()
+	l := &lease{
+		MAC:      mac,
+		IP:       ip,
+		Server:   from,
+		ServerID: reply.Options[dhcp6.OptionServerID],
+		identity: id,
+		Start:    now,
+		Duration: a.Valid,
+		Renew:    ia.T1,
+		Rebind:   ia.T2,
+		Data:     map[string]string{},
+	}
+	if p != nil {
+		l.Mask = p.Subnet.Mask
+	}
+	// RFC 3315 22.4, servers leaving T1 and T2 to us
+	if l.Renew == 0 {
+		l.Renew = a.Preferred / 2
+	}
+	if l.Rebind == 0 {
+		l.Rebind = a.Preferred * 4 / 5
+	}
+	if l.Duration >= dhcp6.Infinity {
+		l.Duration = infiniteLease
+	}
+	var dns []string
+	for _, ip := range reply.Options.IPs(dhcp6.OptionDNSServers) {
+		dns = append(dns, ip.String())
+	}
+	if len(dns) > 0 {
+		l.Data[DataDNS] = strings.Join(dns, ",")
+	}
+	if domains, err := reply.Options.Domains(); err == nil && len(domains) > 0 {
+		l.Data[DataSearch] = strings.Join(domains, ",")
+	}
+	return l, nil
+}
+
+// exchange6 sends rq until a reply of type want arrives, retransmitting
+// the way exchange does
+func exchange6(cn *raw6Conn, rq *dhcp6.Packet, want dhcp6.MessageType, t timing, deadline time.Time) (*dhcp6.Packet, net.IP, error) {
+	start := time.Now()
+	for interval := t.Retransmit; time.Now().Before(deadline); interval = backoff(interval, t.Backoff) {
+		rq.Options.SetElapsedTime(time.Since(start))
+		Log.Debugf("Sending %v on %s", rq, cn.ifi.Name)
+		if err := cn.Send(rq); err != nil {
+			return nil, nil, err
+		}
+		wait := time.Now().Add(interval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		for {
+			p, from, err := cn.Receive(wait)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, nil, err
+			}
+			if p.XID != rq.XID || p.Type != want || !bytes.Equal(p.Options[dhcp6.OptionClientID], rq.Options[dhcp6.OptionClientID]) {
+				continue
+			}
+			Log.Debugf("Received %v from %v", p, from)
+			return p, from, nil
+		}
+	}
+	return nil, nil, ErrDhcpTimeout(want.String())
+}
@@ -0,0 +1,259 @@
+package ipamplugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+	"github.com/xytis/polyp/dhcp"
+)
+
+// conn carries DHCP packets between polyp and DHCP servers
+type conn interface {
+	Send(p *dhcp.Packet, dst net.IP) error
+	// Receive blocks until a DHCP packet arrives or deadline passes
+	Receive(deadline time.Time) (*dhcp.Packet, error)
+	Close() error
+}
+
+// udpConn is a plain UDP socket bound to a host interface
+type udpConn struct {
+	pc *net.UDPConn
+}
+
+func listenUDP(iface string, port int) (*udpConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("could not open dhcp socket: %v", err)
+	}
+	if err := setupUDP(fd, iface, port); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "dhcp-"+iface)
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{pc.(*net.UDPConn)}, nil
+}
+
+func setupUDP(fd int, iface string, port int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return fmt.Errorf("could not set SO_REUSEADDR: %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		return fmt.Errorf("could not set SO_BROADCAST: %v", err)
+	}
+	if iface == "" {
+		// Leave the choice of interface to routing
+	} else if err := syscall.BindToDevice(fd, iface); err != nil {
+		return fmt.Errorf("could not bind dhcp socket to %s: %v", iface, err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: port}); err != nil {
+		return fmt.Errorf("could not bind dhcp socket to port %d: %v", port, err)
+	}
+	return nil
+}
+
+func (c *udpConn) Send(p *dhcp.Packet, dst net.IP) error {
+	_, err := c.pc.WriteToUDP(p.Marshal(), &net.UDPAddr{IP: dst, Port: dhcp.ServerPort})
+	return err
+}
+
+func (c *udpConn) Receive(deadline time.Time) (*dhcp.Packet, error) {
+	if err := c.pc.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.pc.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		if p, err := dhcp.Unmarshal(buf[:n]); err == nil {
+			return p, nil
+		}
+	}
+}
+
+func (c *udpConn) Close() error {
+	return c.pc.Close()
+}
+
+// agentConn tags packets with relay agent information (RFC 3046), telling
+// DHCP servers which host, VLAN and network they come from, be they relayed
+// or not.
+type agentConn struct {
+	conn
+	circuitID string
+	remoteID  string
+}
+
+func (c *agentConn) Send(p *dhcp.Packet, dst net.IP) error {
+	p.Options.SetAgentInfo(c.circuitID, c.remoteID)
+	return c.conn.Send(p, dst)
+}
+
+// turnConn lets the next exchange waiting for its socket address go on once
+// closed
+type turnConn struct {
+	conn
+	turn *sync.Mutex
+}
+
+func (c *turnConn) Close() error {
+	defer c.turn.Unlock()
+	return c.conn.Close()
+}
+
+// relayConn acts as a DHCP relay agent (RFC 1542) towards a single server.
+// Every packet is unicast to the server with giaddr set to our address,
+// and replies come back to the server port.
+type relayConn struct {
+	*udpConn
+	server net.IP
+	giaddr net.IP
+	// Pool subnet, sent along when giaddr does not identify it (RFC 3011)
+	subnet *net.IPNet
+}
+
+func listenRelay(server net.IP, subnet *net.IPNet) (*relayConn, error) {
+	giaddr, err := routeSource(server)
+	if err != nil {
+		return nil, fmt.Errorf("could not find route to dhcp server %v: %v", server, err)
+	}
+	uc, err := listenUDP("", dhcp.ServerPort)
+	if err != nil {
+		return nil, err
+	}
+	return &relayConn{uc, server, giaddr, subnet}, nil
+}
+
+// routeSource returns the local address used to reach dst
+func routeSource(dst net.IP) (net.IP, error) {
+	c, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: dst, Port: dhcp.ServerPort})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.To4(), nil
+}
+
+// Send ignores dst, the server is the only peer of a relay
+func (c *relayConn) Send(p *dhcp.Packet, dst net.IP) error {
+	p.GIAddr = c.giaddr
+	p.Hops = 1
+	if c.subnet != nil && !c.subnet.Contains(c.giaddr) {
+		p.Options.SetIP(dhcp.OptionSubnetSelection, c.subnet.IP)
+	}
+	return c.udpConn.Send(p, c.server)
+}
+
+// rawConn speaks DHCP through a packet socket, building ethernet frames
+// ourselves. This lets packets leave with the container MAC as source and
+// lets us see replies addressed to the container, even when the link is
+// enslaved to a bridge.
+type rawConn struct {
+	ifi *net.Interface
+	pc  net.PacketConn
+	// Hardware addresses of servers which answered before
+	hwaddrs *hwaddrs
+}
+
+// hwaddrs remembers hardware addresses by IP, shared by packet sockets
+type hwaddrs struct {
+	sync.Mutex
+	m map[string]net.HardwareAddr
+}
+
+func (h *hwaddrs) get(ip net.IP) (net.HardwareAddr, bool) {
+	h.Lock()
+	defer h.Unlock()
+	hw, ok := h.m[ip.String()]
+	return hw, ok
+}
+
+func (h *hwaddrs) set(ip net.IP, hw net.HardwareAddr) {
+	h.Lock()
+	defer h.Unlock()
+	h.m[ip.String()] = hw
+}
+
+func listenRaw(ifi *net.Interface, hwaddrs *hwaddrs) (*rawConn, error) {
+	// ETH_P_ALL taps see frames before the bridge consumes them
+	pc, err := raw.ListenPacket(ifi, raw.Protocol(syscall.ETH_P_ALL))
+	if err != nil {
+		return nil, fmt.Errorf("could not open packet socket on %s: %v", ifi.Name, err)
+	}
+	return &rawConn{ifi, pc, hwaddrs}, nil
+}
+
+// Send addresses unicast packets to the hardware address the server
+// answered from before, or falls back to ethernet broadcast.
+func (c *rawConn) Send(p *dhcp.Packet, dst net.IP) error {
+	src := p.CIAddr
+	if src == nil || src.IsUnspecified() {
+		src = net.IPv4zero
+		// Unicast from 0.0.0.0 is dropped as martian, speak from the
+		// address which is being asked for instead
+		if !dst.Equal(net.IPv4bcast) {
+			if ip := p.Options.IP(dhcp.OptionRequestedIPAddress); ip != nil {
+				src = ip
+			}
+		}
+	}
+	hwdst, ok := c.hwaddrs.get(dst)
+	if !ok {
+		hwdst = ethernet.Broadcast
+	}
+	f := &ethernet.Frame{
+		Destination: hwdst,
+		Source:      p.CHAddr,
+		EtherType:   ethernet.EtherTypeIPv4,
+		Payload:     dhcp.Encapsulate(p.Marshal(), src, dst, dhcp.ClientPort, dhcp.ServerPort),
+	}
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.pc.WriteTo(b, &raw.Addr{HardwareAddr: hwdst})
+	return err
+}
+
+func (c *rawConn) Receive(deadline time.Time) (*dhcp.Packet, error) {
+	if err := c.pc.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, c.ifi.MTU+64)
+	for {
+		n, _, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		var f ethernet.Frame
+		if err := f.UnmarshalBinary(buf[:n]); err != nil || f.EtherType != ethernet.EtherTypeIPv4 {
+			continue
+		}
+		payload, src, ok := dhcp.Decapsulate(f.Payload, dhcp.ClientPort)
+		if !ok {
+			continue
+		}
+		if p, err := dhcp.Unmarshal(payload); err == nil {
+			if p.Op == dhcp.BootReply {
+				c.hwaddrs.set(src, f.Source)
+			}
+			return p, nil
+		}
+	}
+}
+
+func (c *rawConn) Close() error {
+	return c.pc.Close()
+}
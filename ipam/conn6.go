@@ -0,0 +1,104 @@
+package ipamplugin
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+
+	"github.com/xytis/polyp/dhcp6"
+)
+
+// raw6Conn speaks DHCPv6 from the link local address of the host through a
+// packet socket, leaving the client port to DHCPv6 clients of the host.
+// Servers bind addresses to the client DUID, not to the address asking, so
+// containers need not be around yet.
+type raw6Conn struct {
+	ifi *net.Interface
+	pc  net.PacketConn
+	src net.IP
+}
+
+func listenRaw6(ifi *net.Interface) (*raw6Conn, error) {
+	src := linkLocal(ifi)
+	if src == nil {
+		return nil, fmt.Errorf("%s has no link local address to speak dhcpv6 from", ifi.Name)
+	}
+	// ETH_P_ALL taps see frames before the bridge consumes them
+	pc, err := raw.ListenPacket(ifi, raw.Protocol(syscall.ETH_P_ALL))
+	if err != nil {
+		return nil, fmt.Errorf("could not open packet socket on %s: %v", ifi.Name, err)
+	}
+	return &raw6Conn{ifi, pc, src}, nil
+}
+
+// linkLocal returns the link local address of ifi, nil when it has none
+func linkLocal(ifi *net.Interface) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() == nil && n.IP.IsLinkLocalUnicast() {
+			return n.IP
+		}
+	}
+	return nil
+}
+
+// multicastHW maps an IPv6 multicast group to its ethernet address
+// (RFC 2464 7)
+func multicastHW(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// Send multicasts p to all servers of the link
+func (c *raw6Conn) Send(p *dhcp6.Packet) error {
+	hwdst := multicastHW(dhcp6.AllServers)
+	f := &ethernet.Frame{
+		Destination: hwdst,
+		Source:      c.ifi.HardwareAddr,
+		EtherType:   ethernet.EtherTypeIPv6,
+		Payload:     dhcp6.Encapsulate(p.Marshal(), c.src, dhcp6.AllServers, dhcp6.ClientPort, dhcp6.ServerPort),
+	}
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.pc.WriteTo(b, &raw.Addr{HardwareAddr: hwdst})
+	return err
+}
+
+// Receive blocks until a DHCPv6 packet for us arrives or deadline passes,
+// and returns it along with the address of its sender
+func (c *raw6Conn) Receive(deadline time.Time) (*dhcp6.Packet, net.IP, error) {
+	if err := c.pc.SetReadDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, c.ifi.MTU+64)
+	for {
+		n, _, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		var f ethernet.Frame
+		if err := f.UnmarshalBinary(buf[:n]); err != nil || f.EtherType != ethernet.EtherTypeIPv6 {
+			continue
+		}
+		payload, src, dst, ok := dhcp6.Decapsulate(f.Payload, dhcp6.ClientPort)
+		if !ok || !dst.Equal(c.src) {
+			continue
+		}
+		if p, err := dhcp6.Unmarshal(payload); err == nil {
+			return p, src, nil
+		}
+	}
+}
+
+func (c *raw6Conn) Close() error {
+	return c.pc.Close()
+}
@@ -1,11 +1,15 @@
 package ipamplugin
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
-	"strings"
+	"net/http"
+	"os"
+	"time"
 
 	ipamapi "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libkv/store"
 	"github.com/docker/libnetwork/netlabel"
 	. "github.com/xytis/polyp/common"
 )
@@ -16,29 +20,151 @@ const (
 	GlobalSpace = `dhcp-global`
 )
 
-type ipam struct {
-	//store store.Store
+// Option key libnetwork uses to tell what kind of address is requested
+const requestAddressType = "RequestAddressType"
+
+// RequestAddress options giving containers a stable identity towards DHCP
+// servers. The hostname defaults to the client identifier.
+const (
+	optClientID = "dhcp-client-id"
+	optHostname = "dhcp-hostname"
+)
+
+// LeasesPath is the plugin endpoint reporting the state of all leases
+const LeasesPath = "/Polyp.Leases"
+
+// Config holds daemon wide settings, pools may override them with options
+type Config struct {
+	// Interface DHCP is broadcast on and VLAN links are created on
+	Interface string
+	// DHCP server to relay to instead of broadcasting, may be empty
+	Server string
+	// Retransmit and timeout policy, zero values pick the defaults
+	Retransmit time.Duration
+	Backoff    float64
+	Timeout    time.Duration
+	// Remote ID of the relay agent information of requests, empty for the
+	// host name
+	AgentID string
+	// External IPAM of rest pools and the API token for it, may be empty
+	RestURL   string
+	RestToken string
 }
 
-func NewIpam() (ipamapi.Ipam, error) {
+type ipam struct {
+	client *client
+	rest   *restClient
+	spaces map[string]*space
+}
 
-	/*
-		localAddr := client.SetLocalAddr(net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 68})
-		remoteAddr := client.SetRemoteAddr(net.UDPAddr{IP: net.ParseIP("192.168.72.254"), Port: 67})
-		sock, err := client.NewInetSock(
-			localAddr,
-			remoteAddr,
-		)
-		if err != nil {
-			return nil, err
+// NewIpam serves the global address space from the cluster store st and
+// the local one from local, a store of this host only
+func NewIpam(config Config, st, local store.Store) (ipamapi.Ipam, error) {
+	if _, err := net.InterfaceByName(config.Interface); err != nil {
+		return nil, fmt.Errorf("could not find dhcp interface %s, (%v)", config.Interface, err)
+	}
+	var server net.IP
+	if config.Server != "" {
+		if server = net.ParseIP(config.Server).To4(); server == nil {
+			return nil, fmt.Errorf("could not parse %s as a dhcp server address", config.Server)
 		}
-		if client, err := client.New(client.Connection(sock)); err != nil {
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(config.Interface, server, timing{
+		Retransmit: config.Retransmit,
+		Backoff:    config.Backoff,
+		Timeout:    config.Timeout,
+	})
+	c.agentID = config.AgentID
+	if c.agentID == "" {
+		c.agentID = host
+	}
+	var rc *restClient
+	if config.RestURL != "" {
+		rc = newRestClient(config.RestURL, config.RestToken)
+	}
+	i := &ipam{
+		client: c,
+		rest:   rc,
+		spaces: map[string]*space{
+			LocalSpace:  spaceNew(LocalSpace, c, rc, host, local),
+			GlobalSpace: spaceNew(GlobalSpace, c, rc, host, st),
+		},
+	}
+	for _, sp := range i.spaces {
+		if err := sp.leases.load(); err != nil {
 			return nil, err
-		} else {
-	*/
-	return &ipam{
-	//store,
-	}, nil
+		}
+		go sp.leases.run(nil)
+	}
+	return i, nil
+}
+
+// NewHandler wraps the IPAM into a plugin handler, which additionally
+// serves lease state on LeasesPath
+func NewHandler(i ipamapi.Ipam) *ipamapi.Handler {
+	h := ipamapi.NewHandler(i)
+	if d, ok := i.(*ipam); ok {
+		h.HandleFunc(LeasesPath, d.serveLeases)
+	}
+	return h
+}
+
+// EndpointHook returns what the network driver calls with endpoints it
+// created, nil unless i comes from NewIpam. Addresses of rest pools get the
+// endpoint in their record.
+func EndpointHook(i ipamapi.Ipam) func(mac net.HardwareAddr, endpoint string) {
+	d, ok := i.(*ipam)
+	if !ok || d.rest == nil {
+		return nil
+	}
+	return d.endpointCreated
+}
+
+func (i *ipam) endpointCreated(mac net.HardwareAddr, endpoint string) {
+	for _, sp := range i.spaces {
+		for _, l := range sp.leases.list() {
+			if l.State != leaseRest || l.MAC.String() != mac.String() {
+				continue
+			}
+			if err := i.rest.tag(l.IP, l.Mask, endpoint); err != nil {
+				Log.Warnf("Could not tag rest ipam address %v with endpoint %s: %v", l.IP, endpoint, err)
+			}
+		}
+	}
+}
+
+// NetworkHook returns what the network driver calls with the pools of
+// networks it created, nil unless i comes from NewIpam. DHCP servers are
+// told the network of addresses requested from those pools.
+func NetworkHook(i ipamapi.Ipam) func(network, space string, subnet *net.IPNet) {
+	d, ok := i.(*ipam)
+	if !ok {
+		return nil
+	}
+	return d.networkCreated
+}
+
+func (i *ipam) networkCreated(network, space string, subnet *net.IPNet) {
+	sp, ok := i.spaces[space]
+	if !ok {
+		return
+	}
+	if err := sp.pools.name(subnet, network); err != nil {
+		Log.Warnf("Could not record network %s on pool %v: %v", network, subnet, err)
+	}
+}
+
+func (i *ipam) serveLeases(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := map[string][]lease{}
+	for name, sp := range i.spaces {
+		res[name] = sp.leases.list()
+	}
+	json.NewEncoder(w).Encode(res)
 }
 
 func (i *ipam) GetCapabilities() (res *ipamapi.CapabilitiesResponse, err error) {
@@ -61,82 +187,321 @@ func (i *ipam) RequestPool(rq *ipamapi.RequestPoolRequest) (res *ipamapi.Request
 	Log.Debugf("RequestPool %v", rq)
 	defer func() { Log.Debugf("RequestPool returning res: %v, err: %v", res, err) }()
 
-	/*
-		p, err := i.client.SendDiscoverPacket()
-		Log.Infof("Response: %v, (err: %v)", p, err)
-		o, err := i.client.GetOffer(&p)
-		Log.Infof("Offer: %v, (err: %v)", o, err)
-	*/
-
 	var (
-		subnet, iprange *net.IPNet
+		sp      *space
+		p       *pool
+		gateway net.IP
 	)
-	if rq.Pool == "" {
-		_, subnet, err = net.ParseCIDR("172.13.0.1/24")
-	} else {
-		_, subnet, err = net.ParseCIDR(rq.Pool)
+	if sp, err = i.space(rq.AddressSpace); err != nil {
+		return
 	}
-	if err != nil {
+	options := rq.Options
+	if rq.V6 {
+		options = v6Options(options)
+	}
+	if p, err = poolNew(options); err != nil {
+		return
+	}
+	if p.Mode == modeRest && i.rest == nil {
+		err = fmt.Errorf("Rest pools need an external ipam, see --rest-url")
+		return
+	} else if p.Mode == modeRest && len(p.Exclude) > 0 {
+		err = fmt.Errorf("Exclusions of rest pools belong in the external ipam")
+		return
+	}
+	if rq.V6 && p.Mode == modeStatic {
+		err = fmt.Errorf("Static pools are only supported for IPv4")
+		return
+	} else if !rq.V6 && p.Mode == modeSlaac {
+		err = fmt.Errorf("Slaac pools need IPv6, see %s", optMode6)
+		return
+	}
+	if rq.Pool == "" && p.Mode == modeStatic {
+		err = fmt.Errorf("Static pools need a subnet")
+		return
+	} else if rq.Pool == "" && p.Mode == modeRest {
+		if p.Prefix == 0 {
+			err = fmt.Errorf("Rest pools need a subnet or a %s", optPrefix)
+			return
+		}
+		if p.Subnet, err = i.rest.prefix(p.Prefix); err != nil {
+			return
+		}
+	} else if rq.Pool == "" && rq.V6 {
+		// Routers tell the prefix, DHCPv6 leases single addresses
+		if p.Subnet, p.DNS, err = i.client.probe6(p); err != nil {
+			err = fmt.Errorf("could not discover pool via router advertisements: %v", err)
+			return
+		}
+		Log.Infof("Discovered pool %v", p.Subnet)
+	} else if rq.Pool == "" {
+		// Let the DHCP server tell what the network looks like
+		if p.Subnet, gateway, err = i.client.probe(p); err != nil {
+			err = fmt.Errorf("could not discover pool via dhcp: %v", err)
+			return
+		}
+		Log.Infof("Discovered pool %v with gateway %v", p.Subnet, gateway)
+	} else if _, p.Subnet, err = net.ParseCIDR(rq.Pool); err != nil {
+		return
+	}
+	if ones, bits := p.Subnet.Mask.Size(); p.Mode == modeSlaac && (ones != 64 || bits != 128) {
+		err = fmt.Errorf("Slaac pools need a /64 IPv6 subnet, not %v", p.Subnet)
 		return
 	}
-	iprange = subnet
+	if p.Mode == modeRest && p.Prefix == 0 {
+		if p.Prefix, err = i.rest.prefixOf(p.Subnet); err != nil {
+			return
+		}
+		Log.Infof("Pool %v is rest prefix %d", p.Subnet, p.Prefix)
+	}
+	p.Range = p.Subnet
 	if rq.SubPool != "" {
-		if _, iprange, err = net.ParseCIDR(rq.SubPool); err != nil {
+		if _, p.Range, err = net.ParseCIDR(rq.SubPool); err != nil {
 			return
 		}
 	}
-	// Cunningly-constructed pool "name" which gives us what we need later
-	poolname := strings.Join([]string{PoolName, subnet.String(), iprange.String()}, "-")
-	// Pass back a fake "gateway address"; we don't actually use it,
-	// so just give the network address.
-	data := map[string]string{
-		netlabel.Gateway: "172.13.0.1/24",
+	if ones, _ := p.Range.Mask.Size(); p.Block != 0 && (p.Mode != modeStatic || p.Block < ones) {
+		err = fmt.Errorf("Blocks of /%d need a static pool with a range of at most that size", p.Block)
+		return
+	}
+	if p.Fallback != nil && !contains(p.Subnet, p.Fallback) {
+		err = fmt.Errorf("Fallback range %v is outside of pool %v", p.Fallback, p.Subnet)
+		return
+	}
+	if gateway != nil && p.Subnet.Contains(gateway) {
+		p.Gateway = gateway
+	}
+	p.Host = sp.leases.host
+	if p, err = sp.pools.acquire(p); err != nil {
+		return
+	}
+	Log.Infof("Pool %s of %v has %d references", p.ID, p.Subnet, p.Refs)
+	// Without a gateway libnetwork requests one through RequestAddress
+	data := map[string]string{}
+	if p.Gateway != nil {
+		data[netlabel.Gateway] = (&net.IPNet{IP: p.Gateway, Mask: p.Subnet.Mask}).String()
 	}
 	res = &ipamapi.RequestPoolResponse{
-		PoolID: poolname,
-		Pool:   subnet.String(),
+		PoolID: p.ID,
+		Pool:   p.Subnet.String(),
 		Data:   data,
 	}
 	return
 }
 
-func (i *ipam) ReleasePool(rq *ipamapi.ReleasePoolRequest) error {
-	Log.Debugln("ReleasePool", rq.PoolID)
-	return nil
+func (i *ipam) ReleasePool(rq *ipamapi.ReleasePoolRequest) (err error) {
+	Log.Debugf("ReleasePool %v", rq)
+	defer func() { Log.Debugf("ReleasePool returned err: %v", err) }()
+	sp := i.spaceOf(rq.PoolID)
+	p, gerr := sp.pools.get(rq.PoolID)
+	if err = sp.pools.release(rq.PoolID); err != nil || gerr != nil {
+		return
+	}
+	if _, err := sp.pools.get(rq.PoolID); err != nil {
+		if _, ok := err.(ErrNoPool); ok {
+			releaseLink(p)
+		}
+	}
+	return
 }
 
 func (i *ipam) RequestAddress(rq *ipamapi.RequestAddressRequest) (res *ipamapi.RequestAddressResponse, err error) {
-	Log.Debugln("RequestAddress %v", rq)
-	defer func() { Log.Debugln("RequestAddress returned res: %v, err: %v", res, err) }()
+	Log.Debugf("RequestAddress %v", rq)
+	defer func() { Log.Debugf("RequestAddress returned res: %v, err: %v", res, err) }()
 	options := rq.Options
+	sp := i.spaceOf(rq.PoolID)
+	p, err := sp.pools.get(rq.PoolID)
+	if err != nil {
+		return
+	}
+	subnet := p.Subnet
+	// Gateway and auxiliary addresses belong to the DHCP server's network,
+	// they are handed back untouched. Static pools reserve them.
+	if options[requestAddressType] == netlabel.Gateway || options[netlabel.MacAddress] == "" {
+		ip := parseIP(rq.Address)
+		owner := netlabel.Gateway
+		if ip == nil && options[requestAddressType] == netlabel.Gateway {
+			// Unknown gateway, assume the first address of the subnet
+			ip = firstAddress(subnet)
+		} else if ip == nil {
+			err = fmt.Errorf("Address %q must be given when no mac address is set", rq.Address)
+			return
+		} else if options[requestAddressType] != netlabel.Gateway {
+			owner = ownerAuxiliary
+		}
+		if p.Mode == modeStatic {
+			if err = sp.claimShared(p, ip, owner); err != nil {
+				return
+			}
+		} else if p.Mode == modeRest {
+			if err = i.rest.reserve(ip, subnet.Mask, owner); err != nil {
+				return
+			}
+		}
+		if owner == netlabel.Gateway && !ip.Equal(p.Gateway) {
+			_, err = sp.pools.update(p.ID, func(cur *pool) *pool {
+				if cur != nil {
+					cur.Gateway = ip
+				}
+				return cur
+			})
+			if err != nil {
+				return
+			}
+		}
+		res = &ipamapi.RequestAddressResponse{
+			Address: (&net.IPNet{IP: ip, Mask: subnet.Mask}).String(),
+		}
+		return
+	}
 	macAddr, err := net.ParseMAC(options[netlabel.MacAddress])
 	if err != nil {
 		err = fmt.Errorf("Mac address not understood %v", options[netlabel.MacAddress])
 		return
 	}
-	parts := strings.Split(rq.PoolID, "-")
-	if len(parts) != 3 || parts[0] != PoolName {
-		err = fmt.Errorf("Unrecognized pool ID: %s", rq.PoolID)
+	// Address preferred by the container, e.g. from docker run --ip
+	var want net.IP
+	if rq.Address != "" {
+		if want = parseIP(rq.Address); want == nil {
+			err = fmt.Errorf("Address not understood %v", rq.Address)
+			return
+		}
+		if !subnet.Contains(want) {
+			err = fmt.Errorf("Address %v is outside of pool %v", want, subnet)
+			return
+		}
+	}
+	id := identity{
+		ClientID: options[optClientID],
+		Hostname: options[optHostname],
+	}
+	if id.Hostname == "" {
+		id.Hostname = id.ClientID
+	}
+	if want, err = p.check(id, want); err != nil {
+		return
+	}
+	// One timeout covers all exchanges and probes, leaving the fallback
+	// time to run before docker gives up on us
+	deadline := i.client.timingOf(p).deadline()
+	var l *lease
+	if p.Mode == modeStatic {
+		l, err = sp.assign(p, p.Range, macAddr, want, leaseStatic)
+	} else if p.Mode == modeRest {
+		l, err = i.rest.assign(p, macAddr, id, want, sp.leases.host)
+	} else if p.Mode == modeSlaac {
+		if l, err = slaacLease(p, macAddr); err == nil && want != nil && !want.Equal(l.IP) {
+			err = ErrAddressRefused{want.String(), macAddr.String() + " configures " + l.IP.String() + " by slaac"}
+		}
+	} else if p.v6() {
+		Log.Debugf("Querying DHCPv6 with: mac %v, id %q, address %v, subnet %v, link %q", macAddr, id.ClientID, want, subnet, p.Link)
+		l, err = i.client.acquire6(p, macAddr, id, want, deadline)
+	} else {
+		Log.Debugf("Querying DHCP with: mac %v, id %q, address %v, subnet %v, iprange %v, link %q", macAddr, id.ClientID, want, subnet, p.Range, p.Link)
+		// Lets embedded servers of polyp networks answer us
+		if err = RegisterMAC(sp.store, macAddr, "ipam"); err != nil {
+			return
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if err := UnregisterMAC(sp.store, macAddr); err != nil {
+				Log.Warnf("Could not unregister %v: %v", macAddr, err)
+			}
+		}()
+		l, err = i.client.acquire(p, macAddr, id, want, deadline)
+	}
+	if _, ok := err.(ErrDhcpTimeout); ok && p.Fallback != nil {
+		Log.Warnf("No dhcp server answered for %v, falling back to %v: %v", macAddr, p.Fallback, err)
+		l, err = sp.fallback(p, macAddr, want)
+	}
+	if err != nil {
 		return
 	}
-	var subnet, iprange *net.IPNet
-	if _, subnet, err = net.ParseCIDR(parts[1]); err != nil {
+	if !subnet.Contains(l.IP) {
+		err = fmt.Errorf("DHCP server leased %v, which is outside of pool %v", l.IP, subnet)
+		sp.release(p, l)
 		return
 	}
-	if _, iprange, err = net.ParseCIDR(parts[2]); err != nil {
+	switch l.State {
+	case leaseStatic:
+		Log.Infof("Assigned %v to %v", l.IP, macAddr)
+	case leaseFallback:
+		Log.Infof("Assigned %v to %v from fallback range %v", l.IP, macAddr, p.Fallback)
+	case leaseRest:
+		Log.Infof("Allocated %v to %v in rest prefix %d", l.IP, macAddr, p.Prefix)
+	case leaseSlaac:
+		Log.Infof("Assigned %v to %v by slaac", l.IP, macAddr)
+	default:
+		Log.Infof("Leased %v to %v from %v for %v", l.IP, macAddr, l.Server, l.Duration)
+	}
+	l.Pool = rq.PoolID
+	if err = sp.leases.add(l); err != nil {
+		sp.release(p, l)
 		return
 	}
-	Log.Debugf("We should query DHCP with: mac %v, subnet %v, iprange %v", macAddr, subnet, iprange)
 	res = &ipamapi.RequestAddressResponse{
-		Address: "172.13.0.84/24",
-		Data: map[string]string{
-			"ohay": "Good day to you too, sir!",
-		},
+		Address: l.address(subnet.Mask).String(),
+		Data:    l.Data,
 	}
 	return
 }
 
 func (i *ipam) ReleaseAddress(rq *ipamapi.ReleaseAddressRequest) (err error) {
-	Log.Debugln("ReleaseAddress %v", rq)
-	return
+	Log.Debugf("ReleaseAddress %v", rq)
+	defer func() { Log.Debugf("ReleaseAddress returned err: %v", err) }()
+	ip := net.ParseIP(rq.Address)
+	if ip == nil {
+		return fmt.Errorf("Address not understood %v", rq.Address)
+	}
+	sp := i.spaceOf(rq.PoolID)
+	l, ok := sp.leases.get(rq.PoolID, ip)
+	if !ok {
+		// Gateway, auxiliary address or a lease we never had
+		Log.Debugf("No lease for %v in pool %s", ip, rq.PoolID)
+		if p, err := sp.pools.get(rq.PoolID); err == nil && p.Mode == modeStatic {
+			return sp.unclaimShared(p, ip)
+		} else if err == nil && p.Mode == modeRest && i.rest != nil {
+			if shared, err := sp.shared(p); err != nil || shared {
+				return err
+			}
+			return i.rest.release(ip, p.Subnet.Mask)
+		}
+		return nil
+	}
+	p, err := sp.pools.get(rq.PoolID)
+	if err != nil {
+		Log.Warnf("Releasing %v of %v on default interface: %v", l.IP, l.MAC, err)
+	} else if err := sp.loadBlocks(p); err != nil {
+		Log.Warnf("Could not load blocks of pool %s: %v", p.ID, err)
+	}
+	sp.leases.rm(rq.PoolID, ip)
+	if err := sp.release(p, l); err != nil {
+		// The lease will expire on its own
+		Log.Warnf("Could not release %v of %v: %v", l.IP, l.MAC, err)
+	} else {
+		Log.Infof("Released %v of %v (%s)", l.IP, l.MAC, l.State)
+	}
+	// Only IPv4 DHCP registers MACs with embedded servers
+	if l.State != leaseStatic && l.State != leaseRest && l.State != leaseSlaac && l.IP.To4() != nil {
+		if err := UnregisterMAC(sp.store, l.MAC); err != nil {
+			Log.Warnf("Could not unregister %v: %v", l.MAC, err)
+		}
+	}
+	return nil
+}
+
+// contains reports whether r lies within subnet
+func contains(subnet, r *net.IPNet) bool {
+	ones, _ := r.Mask.Size()
+	sones, _ := subnet.Mask.Size()
+	return ones >= sones && subnet.Contains(r.IP)
+}
+
+func firstAddress(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip, subnet.IP)
+	ip[len(ip)-1]++
+	return ip
 }
@@ -0,0 +1,16 @@
+package ipamplugin
+
+import (
+	"net"
+
+	. "github.com/xytis/polyp/common"
+)
+
+// fallback leases an address of the fallback range of p to mac, for when
+// no DHCP server answers
+func (sp *space) fallback(p *pool, mac net.HardwareAddr, want net.IP) (*lease, error) {
+	if want != nil && !p.Fallback.Contains(want) {
+		return nil, ErrAddressRefused{want.String(), "no dhcp server answered and it is outside of the fallback range"}
+	}
+	return sp.assign(p, p.Fallback, mac, want, leaseFallback)
+}
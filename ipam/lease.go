@@ -0,0 +1,171 @@
+package ipamplugin
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/xytis/polyp/common"
+	"github.com/xytis/polyp/dhcp"
+)
+
+// Keys of RequestAddressResponse.Data passing on what DHCP servers told
+const (
+	// Comma separated name server addresses
+	DataDNS = "polyp.dhcp.dns"
+	// Comma separated search domains
+	DataSearch = "polyp.dhcp.search"
+	// Comma separated static routes as destination=router, where router
+	// 0.0.0.0 stands for destinations on the link
+	DataRoutes = "polyp.dhcp.routes"
+)
+
+// Lease time meaning the lease never expires (RFC 2131 3.3)
+const infiniteLease = 0xffffffff * time.Second
+
+const (
+	leaseBound     = "bound"
+	leaseRenewing  = "renewing"
+	leaseRebinding = "rebinding"
+	leaseExpired   = "expired"
+	// Assigned from the store instead of by DHCP, never extended
+	leaseFallback = "fallback"
+	leaseStatic   = "static"
+	// Allocated in an external IPAM, see rest.go
+	leaseRest = "rest"
+	// Configured by the container itself, see slaac.go
+	leaseSlaac = "slaac"
+)
+
+// lease is an address bound to a container MAC by a DHCP or DHCPv6 server
+type lease struct {
+	Pool   string
+	MAC    net.HardwareAddr
+	IP     net.IP
+	Mask   net.IPMask
+	Server net.IP
+	// DUID of the DHCPv6 server which granted the lease
+	ServerID []byte `json:",omitempty"`
+	// Client identifier and hostname sent along with every request
+	identity
+	Start time.Time
+	// Lease duration with renewal (T1) and rebinding (T2) times
+	Duration time.Duration
+	Renew    time.Duration
+	Rebind   time.Duration
+	// Options handed to docker, see DataDNS, DataSearch and DataRoutes
+	Data map[string]string
+	// Lease manager bookkeeping
+	State string
+	Error string
+	next  time.Time
+}
+
+func newLease(mac net.HardwareAddr, ack *dhcp.Packet, now time.Time) *lease {
+	l := &lease{
+		MAC:      mac,
+		IP:       ack.YIAddr,
+		Mask:     ack.Options.Mask(),
+		Server:   serverID(ack),
+		Start:    now,
+		Duration: ack.Options.Duration(dhcp.OptionIPAddressLeaseTime),
+		Renew:    ack.Options.Duration(dhcp.OptionRenewalTime),
+		Rebind:   ack.Options.Duration(dhcp.OptionRebindingTime),
+		Data:     leaseData(ack.Options),
+	}
+	// RFC 2131 4.4.5 defaults
+	if l.Renew == 0 {
+		l.Renew = l.Duration / 2
+	}
+	if l.Rebind == 0 {
+		l.Rebind = l.Duration / 8 * 7
+	}
+	return l
+}
+
+func leaseData(o dhcp.Options) map[string]string {
+	data := map[string]string{}
+	if ips := o.IPs(dhcp.OptionDomainNameServer); len(ips) > 0 {
+		dns := make([]string, len(ips))
+		for i, ip := range ips {
+			dns[i] = ip.String()
+		}
+		data[DataDNS] = strings.Join(dns, ",")
+	}
+	if search, err := o.DomainSearch(); err != nil {
+		Log.Warnf("Ignoring malformed domain search option: %v", err)
+	} else if len(search) > 0 {
+		data[DataSearch] = strings.Join(search, ",")
+	} else if domain := o.String(dhcp.OptionDomainName); domain != "" {
+		data[DataSearch] = domain
+	}
+	if routes, err := o.ClasslessRoutes(); err != nil {
+		Log.Warnf("Ignoring malformed classless static route option: %v", err)
+	} else if len(routes) > 0 {
+		rs := make([]string, len(routes))
+		for i, r := range routes {
+			rs[i] = r.Destination.String() + "=" + r.Router.String()
+		}
+		data[DataRoutes] = strings.Join(rs, ",")
+	}
+	return data
+}
+
+// address returns leased IP with its subnet, falling back to mask when
+// the server did not send one
+func (l *lease) address(mask net.IPMask) *net.IPNet {
+	if l.Mask != nil {
+		mask = l.Mask
+	}
+	return &net.IPNet{IP: l.IP, Mask: mask}
+}
+
+// renewAt returns the time at which renewal should start
+func (l *lease) renewAt() time.Time {
+	if l.Duration == 0 || l.Duration >= infiniteLease {
+		return l.Start.Add(100 * 365 * 24 * time.Hour)
+	}
+	return l.Start.Add(l.Renew)
+}
+
+// rebindAt returns the time after which any server may extend the lease
+func (l *lease) rebindAt() time.Time {
+	return l.Start.Add(l.Rebind)
+}
+
+// Stored form of lease with MAC and mask kept readable
+type leaseAlias lease
+type leaseJSON struct {
+	*leaseAlias
+	MAC  string
+	Mask string
+}
+
+func (l *lease) MarshalJSON() ([]byte, error) {
+	return json.Marshal(leaseJSON{
+		leaseAlias: (*leaseAlias)(l),
+		MAC:        l.MAC.String(),
+		Mask:       net.IP(l.Mask).String(),
+	})
+}
+
+func (l *lease) UnmarshalJSON(b []byte) error {
+	var (
+		v   = leaseJSON{leaseAlias: (*leaseAlias)(l)}
+		err error
+	)
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if l.MAC, err = net.ParseMAC(v.MAC); err != nil {
+		return err
+	}
+	if mask := net.ParseIP(v.Mask); mask != nil {
+		if l.IP.To4() != nil {
+			mask = mask.To4()
+		}
+		l.Mask = net.IPMask(mask)
+	}
+	return nil
+}
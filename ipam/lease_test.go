@@ -0,0 +1,115 @@
+package ipamplugin
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xytis/polyp/dhcp"
+)
+
+func TestLeaseJSON(t *testing.T) {
+	start := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []*lease{
+		{
+			Pool:     "dhcp-global-0123456789abcdef",
+			MAC:      net.HardwareAddr{0x02, 0x42, 0x0a, 0x01, 0x00, 0x05},
+			IP:       net.ParseIP("10.1.0.5"),
+			Mask:     net.CIDRMask(24, 32),
+			Server:   net.ParseIP("10.1.0.1"),
+			identity: identity{ClientID: "web-1", Hostname: "web"},
+			Start:    start,
+			Duration: time.Hour,
+			Renew:    30 * time.Minute,
+			Rebind:   52*time.Minute + 30*time.Second,
+			Data:     map[string]string{DataDNS: "10.1.0.2,10.1.0.3", DataSearch: "example.com"},
+			State:    leaseRenewing,
+			Error:    "no reply",
+		},
+		{
+			Pool:     "dhcp-global-fedcba9876543210",
+			MAC:      net.HardwareAddr{0x02, 0x42, 0x0a, 0x01, 0x00, 0x06},
+			IP:       net.ParseIP("2001:db8::6"),
+			Mask:     net.CIDRMask(64, 128),
+			ServerID: []byte{0, 1, 0, 1, 0x1e, 0x2f},
+			Start:    start,
+			Duration: 2 * time.Hour,
+			Renew:    time.Hour,
+			Rebind:   90 * time.Minute,
+			Data:     map[string]string{},
+			State:    leaseBound,
+		},
+		// Without a mask from the server
+		{
+			Pool:  "dhcp-local-0123456789abcdef",
+			MAC:   net.HardwareAddr{0x02, 0x42, 0x0a, 0x01, 0x00, 0x07},
+			IP:    net.ParseIP("10.1.0.7"),
+			Start: start,
+			State: leaseStatic,
+		},
+	}
+	for _, want := range tests {
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &lease{}
+		if err := json.Unmarshal(b, got); err != nil {
+			t.Fatalf("%v: %v", want.IP, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %+v, want %+v from %s", want.IP, got, want, b)
+		}
+	}
+}
+
+func TestLeaseJSONMask(t *testing.T) {
+	l := &lease{}
+	err := json.Unmarshal([]byte(`{"IP":"10.1.0.5","MAC":"02:42:0a:01:00:05","Mask":"255.255.255.0"}`), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Masks of IPv4 leases come back in their 4 byte form
+	if len(l.Mask) != net.IPv4len {
+		t.Errorf("got mask %v of %d bytes", l.Mask, len(l.Mask))
+	}
+	if err := json.Unmarshal([]byte(`{"MAC":"bogus"}`), l); err == nil {
+		t.Error("expected an error for a malformed MAC")
+	}
+}
+
+func TestLeaseTimes(t *testing.T) {
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	never := now.Add(100 * 365 * 24 * time.Hour)
+	tests := []struct {
+		name     string
+		duration time.Duration
+		renew    time.Duration
+		rebind   time.Duration
+		renewAt  time.Time
+		rebindAt time.Time
+	}{
+		{"server times", time.Hour, 20 * time.Minute, 40 * time.Minute, now.Add(20 * time.Minute), now.Add(40 * time.Minute)},
+		// RFC 2131 4.4.5 defaults
+		{"lease time only", time.Hour, 0, 0, now.Add(30 * time.Minute), now.Add(52*time.Minute + 30*time.Second)},
+		{"infinite", infiniteLease, 0, 0, never, now.Add(infiniteLease / 8 * 7)},
+		{"no lease time", 0, 0, 0, never, now},
+	}
+	for _, tt := range tests {
+		ack := &dhcp.Packet{YIAddr: net.ParseIP("10.1.0.5"), Options: dhcp.Options{}}
+		ack.Options.SetDuration(dhcp.OptionIPAddressLeaseTime, tt.duration)
+		if tt.renew != 0 {
+			ack.Options.SetDuration(dhcp.OptionRenewalTime, tt.renew)
+			ack.Options.SetDuration(dhcp.OptionRebindingTime, tt.rebind)
+		}
+		l := newLease(net.HardwareAddr{0x02, 0x42, 0x0a, 0x01, 0x00, 0x05}, ack, now)
+		if got := l.renewAt(); !got.Equal(tt.renewAt) {
+			t.Errorf("%s: renewing at %v, want %v", tt.name, got, tt.renewAt)
+		}
+		if got := l.rebindAt(); !got.Equal(tt.rebindAt) {
+			t.Errorf("%s: rebinding at %v, want %v", tt.name, got, tt.rebindAt)
+		}
+	}
+}
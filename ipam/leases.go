@@ -0,0 +1,310 @@
+package ipamplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/libkv/store"
+	. "github.com/xytis/polyp/common"
+)
+
+func _leases(host string) string {
+	return "polyp/lease/" + host
+}
+
+func _lease(host, key string) string {
+	return _leases(host) + "/" + url.QueryEscape(key)
+}
+
+const (
+	// Shortest pause between attempts to extend a lease (RFC 2131 4.4.5)
+	minRetryInterval = 60 * time.Second
+	// Longest the manager sleeps without looking at its leases
+	maxIdleInterval = time.Minute
+)
+
+// leases tracks every active lease and keeps it alive by renewing it at T1
+// and rebinding it at T2. Leases which could not be extended are kept in
+// the table and retried, so they stay visible until released.
+// Every lease is mirrored to the shared store under the owning host, so
+// that it is picked back up after a restart.
+type leases struct {
+	sync.Mutex
+	client *client
+	pools  *pools
+	host   string
+	store  map[string]*lease
+	shared store.Store
+	wake   chan struct{}
+}
+
+func leasesNew(c *client, ps *pools, host string, st store.Store) *leases {
+	return &leases{
+		client: c,
+		pools:  ps,
+		host:   host,
+		store:  make(map[string]*lease),
+		shared: st,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func leaseKey(pool string, ip net.IP) string {
+	return pool + "/" + ip.String()
+}
+
+func (ls *leases) add(l *lease) error {
+	if l.State == "" {
+		l.State = leaseBound
+	}
+	l.next = l.renewAt()
+	if err := ls.save(l); err != nil {
+		return err
+	}
+	ls.Lock()
+	ls.store[leaseKey(l.Pool, l.IP)] = l
+	ls.Unlock()
+	ls.poke()
+	return nil
+}
+
+func (ls *leases) get(pool string, ip net.IP) (*lease, bool) {
+	ls.Lock()
+	defer ls.Unlock()
+	l, ok := ls.store[leaseKey(pool, ip)]
+	return l, ok
+}
+
+func (ls *leases) rm(pool string, ip net.IP) {
+	ls.Lock()
+	delete(ls.store, leaseKey(pool, ip))
+	ls.Unlock()
+	if err := ls.shared.Delete(_lease(ls.host, leaseKey(pool, ip))); err != nil && err != store.ErrKeyNotFound {
+		Log.Warnf("Could not delete lease %v of pool %s from store: %v", ip, pool, err)
+	}
+}
+
+func (ls *leases) save(l *lease) error {
+	v, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	key := _lease(ls.host, leaseKey(l.Pool, l.IP))
+	if err := ls.shared.Put(key, v, nil); err != nil {
+		return fmt.Errorf("could not write key %s, %v", key, err)
+	}
+	return nil
+}
+
+// LeaseData returns the Data of the lease host holds for mac in any of the
+// stores, which the network driver can not get from docker. Of dual stack
+// containers the IPv4 lease is preferred.
+func LeaseData(host string, mac net.HardwareAddr, stores ...store.Store) (map[string]string, error) {
+	var data6 map[string]string
+	for _, st := range stores {
+		pairs, err := st.List(_leases(host))
+		if err == store.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			l := &lease{}
+			if err := json.Unmarshal(pair.Value, l); err != nil {
+				continue
+			}
+			if l.MAC.String() != mac.String() {
+				continue
+			} else if l.IP.To4() != nil {
+				return l.Data, nil
+			} else if data6 == nil {
+				data6 = l.Data
+			}
+		}
+	}
+	if data6 != nil {
+		return data6, nil
+	}
+	return nil, store.ErrKeyNotFound
+}
+
+// load picks up leases this host held before a restart
+func (ls *leases) load() error {
+	pairs, err := ls.shared.List(_leases(ls.host))
+	if err == store.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not list leases of %s, %v", ls.host, err)
+	}
+	ls.Lock()
+	defer ls.Unlock()
+	for _, pair := range pairs {
+		// Prefix listing may catch hosts sharing a name prefix
+		if !strings.HasPrefix(strings.TrimPrefix(pair.Key, "/"), _leases(ls.host)+"/") {
+			continue
+		}
+		l := &lease{}
+		if err := json.Unmarshal(pair.Value, l); err != nil {
+			Log.Warnf("Skipping unreadable lease %s: %v", pair.Key, err)
+			continue
+		}
+		// Due leases are extended as soon as the manager runs
+		l.next = l.renewAt()
+		ls.store[leaseKey(l.Pool, l.IP)] = l
+		Log.Infof("Recovered lease %v of %v in pool %s (%s)", l.IP, l.MAC, l.Pool, l.State)
+	}
+	ls.poke()
+	return nil
+}
+
+// list returns copies of all leases ordered by pool and address
+func (ls *leases) list() []lease {
+	ls.Lock()
+	defer ls.Unlock()
+	keys := make([]string, 0, len(ls.store))
+	for k := range ls.store {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]lease, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, *ls.store[k])
+	}
+	return res
+}
+
+func (ls *leases) poke() {
+	select {
+	case ls.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run services leases until stop is closed
+func (ls *leases) run(stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ls.wake:
+		case <-timer.C:
+		}
+		next := ls.service(time.Now())
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+		timer.Reset(next.Sub(time.Now()))
+	}
+}
+
+// service extends all leases that are due and returns the time at which
+// it wants to be called again. Leases are extended side by side, so that
+// an unreachable server holds up only its own.
+func (ls *leases) service(now time.Time) time.Time {
+	next := now.Add(maxIdleInterval)
+	var wg sync.WaitGroup
+	for _, l := range ls.due(now) {
+		wg.Add(1)
+		go func(l lease) {
+			defer wg.Done()
+			ls.extend(l, now)
+		}(l)
+	}
+	wg.Wait()
+	ls.Lock()
+	for _, l := range ls.store {
+		if l.next.Before(next) {
+			next = l.next
+		}
+	}
+	ls.Unlock()
+	return next
+}
+
+func (ls *leases) due(now time.Time) []lease {
+	ls.Lock()
+	defer ls.Unlock()
+	var res []lease
+	for _, l := range ls.store {
+		if !l.next.After(now) {
+			res = append(res, *l)
+		}
+	}
+	return res
+}
+
+// extend renews l while it is between T1 and T2, and rebinds it after
+func (ls *leases) extend(l lease, now time.Time) {
+	dst := l.Server
+	state := leaseRenewing
+	if dst == nil || dst.IsUnspecified() || !now.Before(l.rebindAt()) {
+		dst = net.IPv4bcast
+		state = leaseRebinding
+	}
+	Log.Debugf("Extending lease %v of %v (%s)", l.IP, l.MAC, state)
+	p, err := ls.pools.get(l.Pool)
+	if err != nil {
+		Log.Warnf("Extending lease %v of %v on default interface: %v", l.IP, l.MAC, err)
+	}
+	var fresh *lease
+	if l.IP.To4() == nil {
+		fresh, err = ls.client.extend6(p, &l, state == leaseRebinding)
+	} else {
+		fresh, err = ls.client.extend(p, &l, dst)
+	}
+
+	ls.Lock()
+	defer ls.Unlock()
+	cur, ok := ls.store[leaseKey(l.Pool, l.IP)]
+	if !ok {
+		// Released while we were talking to the server
+		return
+	}
+	if err == nil {
+		fresh.State = leaseBound
+		fresh.next = fresh.renewAt()
+		ls.store[leaseKey(l.Pool, l.IP)] = fresh
+		Log.Infof("Lease %v of %v extended for %v", l.IP, l.MAC, fresh.Duration)
+		if err := ls.save(fresh); err != nil {
+			Log.Warnf("Could not store extended lease %v of %v: %v", l.IP, l.MAC, err)
+		}
+		return
+	}
+	cur.Error = err.Error()
+	expiry := cur.Start.Add(cur.Duration)
+	if !now.Before(expiry) {
+		cur.State = leaseExpired
+		cur.next = now.Add(minRetryInterval)
+		Log.Errorf("LEASE LOST: %v of %v in pool %s expired at %v and could not be extended: %v",
+			cur.IP, cur.MAC, cur.Pool, expiry, err)
+		ls.save(cur)
+		return
+	}
+	cur.State = state
+	// Retry after half of the time left until T2 (or expiry while
+	// rebinding), but not sooner than a minute
+	until := cur.rebindAt()
+	if state == leaseRebinding {
+		until = expiry
+	}
+	wait := until.Sub(now) / 2
+	if wait < minRetryInterval {
+		wait = minRetryInterval
+	}
+	cur.next = now.Add(wait)
+	if cur.next.After(expiry) {
+		cur.next = expiry
+	}
+	Log.Warnf("Could not extend lease %v of %v (%s), retrying in %v: %v", cur.IP, cur.MAC, state, wait, err)
+	ls.save(cur)
+}
@@ -0,0 +1,81 @@
+package ipamplugin
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLeasesService(t *testing.T) {
+	ps, dir := newTestPools(t)
+	defer os.RemoveAll(dir)
+	// Extending fails right away, as the link to speak DHCP on is missing
+	ls := leasesNew(newClient("polyp-none0", nil, timing{}), ps, "host1", ps.store)
+	start := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	ip := net.ParseIP("10.1.0.5")
+	if err := ls.add(&lease{
+		Pool:     "dhcp-global-0123456789abcdef",
+		MAC:      net.HardwareAddr{0x02, 0x42, 0x0a, 0x01, 0x00, 0x05},
+		IP:       ip,
+		Server:   net.ParseIP("10.1.0.1"),
+		Start:    start,
+		Duration: time.Hour,
+		Renew:    30 * time.Minute,
+		Rebind:   52*time.Minute + 30*time.Second,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at    time.Duration
+		state string
+		due   bool
+		next  time.Duration
+	}{
+		{10 * time.Minute, leaseBound, false, 30 * time.Minute},
+		// Retried halfway to T2, then to expiry
+		{30 * time.Minute, leaseRenewing, true, 41*time.Minute + 15*time.Second},
+		{41*time.Minute + 15*time.Second, leaseRenewing, true, 46*time.Minute + 52*time.Second + 500*time.Millisecond},
+		{53 * time.Minute, leaseRebinding, true, 56*time.Minute + 30*time.Second},
+		// But not sooner than a minute, nor after expiry
+		{59*time.Minute + 30*time.Second, leaseRebinding, true, 60 * time.Minute},
+		{60 * time.Minute, leaseExpired, true, 61 * time.Minute},
+	}
+	for _, tt := range tests {
+		now := start.Add(tt.at)
+		if due := len(ls.due(now)) > 0; due != tt.due {
+			t.Errorf("at %v: due %v, want %v", tt.at, due, tt.due)
+		}
+		// The manager looks again at the next retry, or after idling
+		want := start.Add(tt.next)
+		if idle := now.Add(maxIdleInterval); idle.Before(want) {
+			want = idle
+		}
+		if next := ls.service(now); !next.Equal(want) {
+			t.Errorf("at %v: next service at %v, want %v", tt.at, next.Sub(start), want.Sub(start))
+		}
+		l, ok := ls.get("dhcp-global-0123456789abcdef", ip)
+		if !ok {
+			t.Fatalf("at %v: lease gone", tt.at)
+		}
+		if l.State != tt.state {
+			t.Errorf("at %v: lease %s, want %s", tt.at, l.State, tt.state)
+		}
+		if !l.next.Equal(start.Add(tt.next)) {
+			t.Errorf("at %v: lease retried at %v, want %v", tt.at, l.next.Sub(start), tt.next)
+		}
+		if tt.due && l.Error == "" {
+			t.Errorf("at %v: failure not recorded", tt.at)
+		}
+	}
+
+	// Expired leases stay until released
+	if len(ls.list()) != 1 {
+		t.Errorf("got leases %v before release", ls.list())
+	}
+	ls.rm("dhcp-global-0123456789abcdef", ip)
+	if len(ls.list()) != 0 {
+		t.Errorf("got leases %v after release", ls.list())
+	}
+}
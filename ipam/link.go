@@ -0,0 +1,61 @@
+package ipamplugin
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	. "github.com/xytis/polyp/common"
+)
+
+// LinkAlias tags VLAN links created for DHCP of pools. The network driver
+// adopts links so tagged, retagging them as its own, and ReleasePool
+// deletes those left over.
+const LinkAlias = "polyp:"
+
+// poolLink returns the interface DHCP for p is spoken on. VLAN links are
+// created the same way the network driver does, so that it picks them up
+// when the first endpoint is attached.
+func poolLink(p *pool, parent string) (*net.Interface, error) {
+	if _, err := netlink.LinkByName(p.Link); err != nil && p.Vlan != 0 {
+		if p.Parent != "" {
+			parent = p.Parent
+		}
+		pli, err := netlink.LinkByName(parent)
+		if err != nil {
+			return nil, ErrNetlinkError{"find parent iface by name (" + parent + ")", err}
+		}
+		la := netlink.NewLinkAttrs()
+		la.Name = p.Link
+		la.ParentIndex = pli.Attrs().Index
+		vl := &netlink.Vlan{LinkAttrs: la, VlanId: p.Vlan}
+		if err := netlink.LinkAdd(vl); err != nil {
+			return nil, ErrNetlinkError{"create vlan iface", err}
+		}
+		if err := netlink.LinkSetAlias(vl, LinkAlias); err != nil {
+			netlink.LinkDel(vl)
+			return nil, ErrNetlinkError{"tag vlan iface", err}
+		}
+		if err := netlink.LinkSetUp(vl); err != nil {
+			return nil, ErrNetlinkError{"bring vlan iface up", err}
+		}
+		Log.Infof("Created %s on %s for dhcp of vlan %d", p.Link, parent, p.Vlan)
+	}
+	return net.InterfaceByName(p.Link)
+}
+
+// releaseLink deletes the VLAN link poolLink created for p, unless the
+// network driver adopted it meanwhile
+func releaseLink(p *pool) {
+	if p.Vlan == 0 {
+		return
+	}
+	li, err := netlink.LinkByName(p.Link)
+	if err != nil || li.Attrs().Alias != LinkAlias {
+		return
+	}
+	if err := netlink.LinkDel(li); err != nil {
+		Log.Warnf("Could not delete %s of released pool %s: %v", p.Link, p.ID, err)
+		return
+	}
+	Log.Infof("Deleted %s of released pool %s", p.Link, p.ID)
+}
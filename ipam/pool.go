@@ -0,0 +1,455 @@
+package ipamplugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/xytis/polyp/common"
+)
+
+// IPAM options understood by RequestPool
+const (
+	optMode = "mode"
+	// Mode of the IPv6 pool of dual stack networks
+	optMode6  = "mode6"
+	optParent = "parent"
+	optVlan   = "vlan"
+	optIface  = "iface"
+	optServer = "dhcp-server"
+	// Network named to DHCP servers in relay agent information until a
+	// docker network is created on the pool
+	optNetwork = "dhcp-network"
+	// Overrides of the daemon wide DHCP timing
+	optRetransmit = "dhcp-retransmit"
+	optBackoff    = "dhcp-backoff"
+	optTimeout    = "dhcp-timeout"
+	// Addresses handed out from the store when no DHCP server answers
+	optFallback = "fallback-range"
+	// Prefix length of address blocks hosts claim in static mode
+	optBlock = "block"
+	// Addresses never handed out, as first-last[,first-last]
+	optExclude = "exclude"
+	// Addresses kept for containers of a name, as name:ip[,name:ip]
+	optReserve = "reserve"
+	// ID of the prefix in the external IPAM of rest mode
+	optPrefix = "rest-prefix"
+)
+
+// Values of optMode
+const (
+	// Addresses are leased from DHCP servers
+	modeDHCP = "dhcp"
+	// Addresses are allocated from the pool range in the shared store
+	modeStatic = "static"
+	// Addresses are allocated in an external IPAM over REST
+	modeRest = "rest"
+	// IPv6 addresses are derived from container MACs in the prefix
+	// routers advertise, as containers configure them themselves
+	modeSlaac = "slaac"
+)
+
+// pool describes where and how addresses of a docker pool are leased. It
+// is kept in the shared store as a record under its ID.
+type pool struct {
+	ID     string
+	Mode   string
+	Subnet *net.IPNet
+	Range  *net.IPNet
+	// Interface the VLAN link is created on, empty for the default one
+	Parent string
+	Vlan   int
+	// Link DHCP is spoken on, empty to use the parent interface directly
+	Link string
+	// Server DHCP is relayed to, nil for the daemon default
+	Server net.IP
+	// Network name sent in the agent circuit ID, empty for the pool ID
+	Network string
+	// Docker network first created on the pool, told by the network driver.
+	// Sent in the agent circuit ID once known.
+	NetworkID string `json:",omitempty"`
+	// Zero values stand for the daemon default
+	Timing timing
+	// Range used when DHCP times out, nil to fail instead
+	Fallback *net.IPNet
+	// Prefix length of per host blocks, 0 to allocate addresses one by one
+	Block int
+	// Addresses containers never get
+	Exclude []ipRange
+	// Addresses only the container of the name gets
+	Reserve map[string]net.IP
+	// Prefix ID in the external IPAM, 0 unless in rest mode
+	Prefix int
+	// Gateway discovered or handed to docker, may be nil
+	Gateway net.IP
+	// Name servers routers of slaac pools advertised
+	DNS []net.IP `json:",omitempty"`
+	// Host which created the record, and count of RequestPool calls
+	// which were not released yet
+	Host string
+	Refs int
+}
+
+// ipRange is an inclusive range of IPv4 addresses
+type ipRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+func parseIPRange(s string) (ipRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	r := ipRange{First: net.ParseIP(parts[0]).To4()}
+	r.Last = r.First
+	if len(parts) == 2 {
+		r.Last = net.ParseIP(parts[1]).To4()
+	}
+	if r.First == nil || r.Last == nil || bytes.Compare(r.First, r.Last) > 0 {
+		return r, fmt.Errorf("could not parse %s as an address range", s)
+	}
+	return r, nil
+}
+
+// Contains compares 4 byte forms, stored ranges come back in 16 bytes
+func (r ipRange) Contains(ip net.IP) bool {
+	ip = ip.To4()
+	return ip != nil && bytes.Compare(r.First.To4(), ip) <= 0 && bytes.Compare(ip, r.Last.To4()) <= 0
+}
+
+func (r ipRange) String() string {
+	if r.First.Equal(r.Last) {
+		return r.First.String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// excluded reports whether ip must never be handed out
+func (p *pool) excluded(ip net.IP) bool {
+	for _, r := range p.Exclude {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedFor returns the name ip is reserved for, if any
+func (p *pool) reservedFor(ip net.IP) (string, bool) {
+	for name, rip := range p.Reserve {
+		if rip.Equal(ip) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// check returns the address a container known as id gets, given it wants
+// want, which may be nil
+func (p *pool) check(id identity, want net.IP) (net.IP, error) {
+	rip, ok := p.Reserve[id.ClientID]
+	if !ok {
+		rip, ok = p.Reserve[id.Hostname]
+	}
+	switch {
+	case ok && want == nil:
+		return rip, nil
+	case ok && !want.Equal(rip):
+		return nil, ErrAddressRefused{want.String(), "a different address is reserved for the container"}
+	case want == nil:
+		return nil, nil
+	case p.excluded(want):
+		return nil, ErrAddressRefused{want.String(), "it is excluded from the pool"}
+	}
+	if name, reserved := p.reservedFor(want); reserved && name != id.ClientID && name != id.Hostname {
+		return nil, ErrAddressRefused{want.String(), "it is reserved for " + name}
+	}
+	return want, nil
+}
+
+// v6 reports whether p is an IPv6 pool
+func (p *pool) v6() bool {
+	return p.Subnet.IP.To4() == nil
+}
+
+// allowed reports whether ip may be handed out to a container which did
+// not ask for it
+func (p *pool) allowed(ip net.IP) bool {
+	_, reserved := p.reservedFor(ip)
+	return !reserved && !p.excluded(ip)
+}
+
+// v6Options returns the options of the IPv6 pool of a network, which
+// docker hands the same IPAM options as its IPv4 pool. Options naming
+// IPv4 addresses are left out.
+func v6Options(options map[string]string) map[string]string {
+	v6 := map[string]string{}
+	for k, v := range options {
+		switch k {
+		case optMode, optServer, optFallback, optBlock, optExclude, optReserve, optPrefix:
+		case optMode6:
+			v6[optMode] = v
+		default:
+			v6[k] = v
+		}
+	}
+	return v6
+}
+
+// poolNew builds a pool from the IPAM options given to RequestPool, its
+// subnet and range are left for the caller to fill in
+func poolNew(options map[string]string) (*pool, error) {
+	p := &pool{
+		Mode:    options[optMode],
+		Parent:  options[optParent],
+		Link:    options[optIface],
+		Network: options[optNetwork],
+	}
+	switch p.Mode {
+	case "":
+		p.Mode = modeDHCP
+	case modeDHCP, modeStatic, modeRest, modeSlaac:
+	default:
+		return nil, fmt.Errorf("unknown pool mode %s", p.Mode)
+	}
+	if prefix := options[optPrefix]; prefix != "" {
+		var err error
+		if p.Prefix, err = strconv.Atoi(prefix); err != nil || p.Prefix < 1 || p.Mode != modeRest {
+			return nil, fmt.Errorf("could not parse %s as a prefix id of a rest pool", prefix)
+		}
+	}
+	if vlan := options[optVlan]; vlan != "" {
+		var err error
+		if p.Vlan, err = strconv.Atoi(vlan); err != nil || p.Vlan < 1 || p.Vlan > 4094 {
+			return nil, fmt.Errorf("could not parse %s as a vlan id", vlan)
+		}
+		if p.Link == "" {
+			p.Link = "vlan" + strconv.Itoa(p.Vlan)
+		}
+	}
+	if server := options[optServer]; server != "" {
+		if p.Server = net.ParseIP(server).To4(); p.Server == nil {
+			return nil, fmt.Errorf("could not parse %s as a dhcp server address", server)
+		}
+	}
+	var err error
+	if p.Timing.Retransmit, err = parseDuration(options, optRetransmit); err != nil {
+		return nil, err
+	}
+	if p.Timing.Timeout, err = parseDuration(options, optTimeout); err != nil {
+		return nil, err
+	}
+	if backoff := options[optBackoff]; backoff != "" {
+		if p.Timing.Backoff, err = strconv.ParseFloat(backoff, 64); err != nil || p.Timing.Backoff < 1 {
+			return nil, fmt.Errorf("could not parse %s as a backoff factor of at least 1", backoff)
+		}
+	}
+	if fallback := options[optFallback]; fallback != "" {
+		if _, p.Fallback, err = net.ParseCIDR(fallback); err != nil {
+			return nil, fmt.Errorf("could not parse %s as a fallback range", fallback)
+		}
+	}
+	if block := options[optBlock]; block != "" {
+		if p.Block, err = strconv.Atoi(block); err != nil || p.Block < 1 || p.Block > 30 {
+			return nil, fmt.Errorf("could not parse %s as a block prefix length", block)
+		}
+	}
+	if exclude := options[optExclude]; exclude != "" {
+		for _, e := range strings.Split(exclude, ",") {
+			r, err := parseIPRange(strings.TrimSpace(e))
+			if err != nil {
+				return nil, err
+			}
+			p.Exclude = append(p.Exclude, r)
+		}
+	}
+	if reserve := options[optReserve]; reserve != "" {
+		p.Reserve = map[string]net.IP{}
+		for _, r := range strings.Split(reserve, ",") {
+			parts := strings.SplitN(strings.TrimSpace(r), ":", 2)
+			if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]).To4() == nil {
+				return nil, fmt.Errorf("could not parse %s as a reservation of name:address", r)
+			}
+			p.Reserve[parts[0]] = net.ParseIP(parts[1]).To4()
+		}
+	}
+	return p, nil
+}
+
+// parseIP parses s keeping IPv4 addresses in their 4 byte form
+func parseIP(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func parseDuration(options map[string]string, key string) (time.Duration, error) {
+	v := options[key]
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("could not parse %s as %s", v, key)
+	}
+	return d, nil
+}
+
+// key describes p in the form pool IDs used to have:
+// dhcp-<subnet>-<range>[-<options>]
+func (p *pool) key() string {
+	parts := []string{PoolName, p.Subnet.String(), p.Range.String()}
+	if opts := p.options().Encode(); opts != "" {
+		parts = append(parts, opts)
+	}
+	return strings.Join(parts, "-")
+}
+
+// newID derives the ID of p in space from its key, so that equal pools
+// requested by several networks share a record
+func (p *pool) newID(space string) string {
+	sum := sha256.Sum256([]byte(p.key()))
+	return space + "-" + hex.EncodeToString(sum[:8])
+}
+
+func (p *pool) options() url.Values {
+	v := url.Values{}
+	if p.Mode != modeDHCP {
+		v.Set(optMode, p.Mode)
+	}
+	if p.Parent != "" {
+		v.Set(optParent, p.Parent)
+	}
+	if p.Vlan != 0 {
+		v.Set(optVlan, strconv.Itoa(p.Vlan))
+	}
+	if p.Link != "" {
+		v.Set(optIface, p.Link)
+	}
+	if p.Server != nil {
+		v.Set(optServer, p.Server.String())
+	}
+	if p.Network != "" {
+		v.Set(optNetwork, p.Network)
+	}
+	if p.Timing.Retransmit != 0 {
+		v.Set(optRetransmit, p.Timing.Retransmit.String())
+	}
+	if p.Timing.Backoff != 0 {
+		v.Set(optBackoff, strconv.FormatFloat(p.Timing.Backoff, 'g', -1, 64))
+	}
+	if p.Timing.Timeout != 0 {
+		v.Set(optTimeout, p.Timing.Timeout.String())
+	}
+	if p.Fallback != nil {
+		v.Set(optFallback, p.Fallback.String())
+	}
+	if p.Block != 0 {
+		v.Set(optBlock, strconv.Itoa(p.Block))
+	}
+	if len(p.Exclude) > 0 {
+		rs := make([]string, len(p.Exclude))
+		for k, r := range p.Exclude {
+			rs[k] = r.String()
+		}
+		v.Set(optExclude, strings.Join(rs, ","))
+	}
+	if len(p.Reserve) > 0 {
+		rs := make([]string, 0, len(p.Reserve))
+		for name, ip := range p.Reserve {
+			rs = append(rs, name+":"+ip.String())
+		}
+		sort.Strings(rs)
+		v.Set(optReserve, strings.Join(rs, ","))
+	}
+	if p.Prefix != 0 {
+		v.Set(optPrefix, strconv.Itoa(p.Prefix))
+	}
+	return v
+}
+
+// parseLegacyPoolID reads pool IDs handed out before pools were stored,
+// which docker keeps for networks created back then. They are pool keys.
+func parseLegacyPoolID(id string) (*pool, error) {
+	parts := strings.SplitN(id, "-", 4)
+	if len(parts) < 3 || parts[0] != PoolName {
+		return nil, fmt.Errorf("Unrecognized pool ID: %s", id)
+	}
+	var (
+		subnet, iprange *net.IPNet
+		err             error
+	)
+	if _, subnet, err = net.ParseCIDR(parts[1]); err != nil {
+		return nil, err
+	}
+	if _, iprange, err = net.ParseCIDR(parts[2]); err != nil {
+		return nil, err
+	}
+	options := map[string]string{}
+	if len(parts) == 4 {
+		v, err := url.ParseQuery(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("Unrecognized pool ID options: %s", parts[3])
+		}
+		for k := range v {
+			options[k] = v.Get(k)
+		}
+	}
+	p, err := poolNew(options)
+	if err != nil {
+		return nil, err
+	}
+	p.ID, p.Subnet, p.Range = id, subnet, iprange
+	return p, nil
+}
+
+// Stored form of pool with networks kept readable
+type poolAlias pool
+type poolJSON struct {
+	*poolAlias
+	Subnet   string
+	Range    string
+	Fallback string `json:",omitempty"`
+}
+
+func (p *pool) MarshalJSON() ([]byte, error) {
+	v := poolJSON{
+		poolAlias: (*poolAlias)(p),
+		Subnet:    p.Subnet.String(),
+		Range:     p.Range.String(),
+	}
+	if p.Fallback != nil {
+		v.Fallback = p.Fallback.String()
+	}
+	return json.Marshal(v)
+}
+
+func (p *pool) UnmarshalJSON(b []byte) error {
+	var (
+		v   = poolJSON{poolAlias: (*poolAlias)(p)}
+		err error
+	)
+	if err = json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if _, p.Subnet, err = net.ParseCIDR(v.Subnet); err != nil {
+		return err
+	}
+	if _, p.Range, err = net.ParseCIDR(v.Range); err != nil {
+		return err
+	}
+	if v.Fallback != "" {
+		if _, p.Fallback, err = net.ParseCIDR(v.Fallback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package ipamplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/xytis/polyp/common"
+)
+
+func TestParseLegacyPoolID(t *testing.T) {
+	tests := []struct {
+		id      string
+		subnet  string
+		iprange string
+		mode    string
+		vlan    int
+		link    string
+		timeout time.Duration
+		err     bool
+	}{
+		{id: "dhcp-10.1.0.0/24-10.1.0.0/24", subnet: "10.1.0.0/24", iprange: "10.1.0.0/24", mode: modeDHCP},
+		{id: "dhcp-10.1.0.0/24-10.1.0.128/25", subnet: "10.1.0.0/24", iprange: "10.1.0.128/25", mode: modeDHCP},
+		{id: "dhcp-10.1.0.0/24-10.1.0.0/24-mode=static", subnet: "10.1.0.0/24", iprange: "10.1.0.0/24", mode: modeStatic},
+		{id: "dhcp-10.1.0.0/24-10.1.0.0/24-vlan=72", subnet: "10.1.0.0/24", iprange: "10.1.0.0/24", mode: modeDHCP, vlan: 72, link: "vlan72"},
+		// Options may hold dashes of their own
+		{id: "dhcp-10.1.0.0/24-10.1.0.0/24-dhcp-timeout=5s&iface=br-72", subnet: "10.1.0.0/24", iprange: "10.1.0.0/24", mode: modeDHCP, link: "br-72", timeout: 5 * time.Second},
+		{id: "dhcp-global-0123456789abcdef", err: true},
+		{id: "dhcp-10.1.0.0/24", err: true},
+		{id: "pool-10.1.0.0/24-10.1.0.0/24", err: true},
+		{id: "dhcp-10.1.0.0-10.1.0.0/24", err: true},
+		{id: "dhcp-10.1.0.0/24-10.1.0.0/24-%zz", err: true},
+		{id: "dhcp-10.1.0.0/24-10.1.0.0/24-mode=bogus", err: true},
+	}
+	for _, tt := range tests {
+		p, err := parseLegacyPoolID(tt.id)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got pool %+v", tt.id, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.id, err)
+			continue
+		}
+		if p.ID != tt.id || p.Subnet.String() != tt.subnet || p.Range.String() != tt.iprange {
+			t.Errorf("%s: got ID %s, subnet %v, range %v", tt.id, p.ID, p.Subnet, p.Range)
+		}
+		if p.Mode != tt.mode || p.Vlan != tt.vlan || p.Link != tt.link || p.Timing.Timeout != tt.timeout {
+			t.Errorf("%s: got mode %s, vlan %d, link %q, timeout %v", tt.id, p.Mode, p.Vlan, p.Link, p.Timing.Timeout)
+		}
+	}
+}
+
+func TestLegacyPoolIDRoundTrip(t *testing.T) {
+	for _, options := range []map[string]string{
+		{},
+		{optMode: modeStatic, optBlock: "28", optExclude: "10.1.0.1-10.1.0.20"},
+		{optVlan: "72", optParent: "eth1", optServer: "10.9.0.254", optFallback: "10.1.0.240/28"},
+		{optReserve: "web:10.1.0.50,db:10.1.0.51", optBackoff: "1.5", optRetransmit: "1s"},
+	} {
+		p, err := poolNew(options)
+		if err != nil {
+			t.Fatalf("%v: %v", options, err)
+		}
+		p.Subnet = mustCIDR(t, "10.1.0.0/24")
+		p.Range = mustCIDR(t, "10.1.0.0/25")
+		key := p.key()
+		parsed, err := parseLegacyPoolID(key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+		} else if parsed.key() != key {
+			t.Errorf("%s: parsed back as %s", key, parsed.key())
+		}
+	}
+}
+
+func TestPoolCheck(t *testing.T) {
+	p, err := poolNew(map[string]string{
+		optExclude: "10.1.0.1-10.1.0.9,10.1.0.20",
+		optReserve: "web:10.1.0.30,db-1:10.1.0.31",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Subnet = mustCIDR(t, "10.1.0.0/24")
+	p.Range = mustCIDR(t, "10.1.0.0/26")
+	tests := []struct {
+		name string
+		id   identity
+		want string
+		got  string
+		err  bool
+	}{
+		{"anything", identity{}, "", "", false},
+		{"reserved by hostname", identity{Hostname: "web"}, "", "10.1.0.30", false},
+		{"reserved by client ID", identity{ClientID: "db-1", Hostname: "db"}, "", "10.1.0.31", false},
+		{"own reservation", identity{Hostname: "web"}, "10.1.0.30", "10.1.0.30", false},
+		{"other than reserved", identity{Hostname: "web"}, "10.1.0.40", "", true},
+		{"reserved for another", identity{Hostname: "app"}, "10.1.0.30", "", true},
+		{"excluded", identity{}, "10.1.0.5", "", true},
+		{"excluded range end", identity{}, "10.1.0.9", "", true},
+		{"excluded single", identity{}, "10.1.0.20", "", true},
+		{"free", identity{}, "10.1.0.10", "10.1.0.10", false},
+		// Addresses asked for may lie outside of the range, as with docker
+		{"outside of the range", identity{}, "10.1.0.200", "10.1.0.200", false},
+	}
+	for _, tt := range tests {
+		got, err := p.check(tt.id, parseIP(tt.want))
+		if tt.err {
+			if _, ok := err.(ErrAddressRefused); !ok {
+				t.Errorf("%s: got %v, %v, want the address refused", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || parseIP(tt.got).String() != got.String() {
+			t.Errorf("%s: got %v, %v, want %s", tt.name, got, err, tt.got)
+		}
+	}
+}
+
+func TestPoolAllowed(t *testing.T) {
+	p, err := poolNew(map[string]string{
+		optExclude: "10.1.0.1-10.1.0.9",
+		optReserve: "web:10.1.0.30",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.0.1", false},
+		{"10.1.0.9", false},
+		{"10.1.0.10", true},
+		{"10.1.0.30", false},
+		{"10.1.0.31", true},
+		{"2001:db8::1", true},
+	}
+	for _, tt := range tests {
+		if got := p.allowed(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("%s: allowed %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+package ipamplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/docker/libkv/store"
+	. "github.com/xytis/polyp/common"
+)
+
+func _pools() string {
+	return "polyp/pool"
+}
+
+func _pool(id string) string {
+	return _pools() + "/" + id
+}
+
+// pools keeps pool records of an address space in its store. Records are
+// read afresh every time, as other hosts change their references.
+type pools struct {
+	space string
+	store store.Store
+}
+
+func poolsNew(space string, st store.Store) *pools {
+	return &pools{
+		space: space,
+		store: st,
+	}
+}
+
+// get returns the pool of id
+func (ps *pools) get(id string) (*pool, error) {
+	pair, err := ps.store.Get(_pool(id))
+	if err == store.ErrKeyNotFound {
+		if p, err := parseLegacyPoolID(id); err == nil {
+			return p, nil
+		}
+		return nil, ErrNoPool(id)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read pool %s: %v", id, err)
+	}
+	p := &pool{}
+	if err := json.Unmarshal(pair.Value, p); err != nil {
+		return nil, fmt.Errorf("could not read pool %s: %v", id, err)
+	}
+	return p, nil
+}
+
+// acquire stores p, or takes another reference on the equal pool stored
+// already, returning the stored record. Pools overlapping others of the
+// space are refused.
+func (ps *pools) acquire(p *pool) (*pool, error) {
+	p.ID = p.newID(ps.space)
+	pairs, err := ps.store.List(_pools())
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, fmt.Errorf("could not list pools: %v", err)
+	}
+	for _, pair := range pairs {
+		other := &pool{}
+		if err := json.Unmarshal(pair.Value, other); err != nil {
+			Log.Warnf("Skipping unreadable pool %s: %v", pair.Key, err)
+			continue
+		}
+		if other.ID != p.ID && overlaps(other.Subnet, p.Subnet) {
+			return nil, ErrPoolConflict{p.Subnet.String(), other.ID}
+		}
+	}
+	return ps.update(p.ID, func(cur *pool) *pool {
+		if cur == nil {
+			cur = p
+		}
+		cur.Refs++
+		return cur
+	})
+}
+
+// name records network as the docker network of the pool of subnet, unless
+// another one was created on it first
+func (ps *pools) name(subnet *net.IPNet, network string) error {
+	pairs, err := ps.store.List(_pools())
+	if err != nil && err != store.ErrKeyNotFound {
+		return fmt.Errorf("could not list pools: %v", err)
+	}
+	for _, pair := range pairs {
+		p := &pool{}
+		if err := json.Unmarshal(pair.Value, p); err != nil || p.Subnet.String() != subnet.String() {
+			continue
+		}
+		_, err := ps.update(p.ID, func(cur *pool) *pool {
+			if cur != nil && cur.NetworkID == "" {
+				cur.NetworkID = network
+			}
+			return cur
+		})
+		return err
+	}
+	return nil
+}
+
+// release drops a reference on the pool of id, removing the record with
+// the last one
+func (ps *pools) release(id string) error {
+	_, err := ps.update(id, func(cur *pool) *pool {
+		if cur == nil {
+			return nil
+		}
+		cur.Refs--
+		if cur.Refs <= 0 {
+			return nil
+		}
+		return cur
+	})
+	return err
+}
+
+// update applies fn to the record of id atomically, retrying when someone
+// else changed it in between. fn gets nil for a missing record, and
+// returns nil to have the record removed.
+func (ps *pools) update(id string, fn func(cur *pool) *pool) (*pool, error) {
+	key := _pool(id)
+	for {
+		var cur *pool
+		pair, err := ps.store.Get(key)
+		if err == store.ErrKeyNotFound {
+			pair = nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read pool %s: %v", id, err)
+		} else {
+			cur = &pool{}
+			if err := json.Unmarshal(pair.Value, cur); err != nil {
+				return nil, fmt.Errorf("could not read pool %s: %v", id, err)
+			}
+		}
+		next := fn(cur)
+		switch {
+		case next == nil && pair == nil:
+			return nil, nil
+		case next == nil:
+			_, err = ps.store.AtomicDelete(key, pair)
+		default:
+			var v []byte
+			if v, err = json.Marshal(next); err != nil {
+				return nil, err
+			}
+			_, _, err = ps.store.AtomicPut(key, v, pair, nil)
+		}
+		if err == store.ErrKeyModified || err == store.ErrKeyExists || err == store.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not write pool %s: %v", id, err)
+		}
+		return next, nil
+	}
+}
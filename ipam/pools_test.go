@@ -0,0 +1,161 @@
+package ipamplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/libkv/store"
+	. "github.com/xytis/polyp/common"
+)
+
+// newTestStore returns a store kept in a new temporary directory, which
+// the caller removes
+func newTestStore(t *testing.T) (store.Store, string) {
+	dir, err := ioutil.TempDir("", "polyp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewFileStore(filepath.Join(dir, "local.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return st, dir
+}
+
+func newTestPools(t *testing.T) (*pools, string) {
+	st, dir := newTestStore(t)
+	return poolsNew(LocalSpace, st), dir
+}
+
+func newTestPool(t *testing.T, subnet string, options map[string]string) *pool {
+	p, err := poolNew(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Subnet = mustCIDR(t, subnet)
+	p.Range = p.Subnet
+	return p
+}
+
+func TestPoolsOverlap(t *testing.T) {
+	ps, dir := newTestPools(t)
+	defer os.RemoveAll(dir)
+	first, err := ps.acquire(newTestPool(t, "10.1.0.0/24", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		subnet   string
+		options  map[string]string
+		conflict bool
+		refs     int
+	}{
+		{"equal pool", "10.1.0.0/24", nil, false, 2},
+		{"within", "10.1.0.0/25", nil, true, 0},
+		{"around", "10.0.0.0/8", nil, true, 0},
+		{"same subnet, other options", "10.1.0.0/24", map[string]string{optVlan: "72"}, true, 0},
+		{"disjoint", "10.2.0.0/24", nil, false, 1},
+		{"adjacent", "10.1.1.0/24", nil, false, 1},
+	}
+	for _, tt := range tests {
+		p, err := ps.acquire(newTestPool(t, tt.subnet, tt.options))
+		if tt.conflict {
+			if e, ok := err.(ErrPoolConflict); !ok {
+				t.Errorf("%s: got %v, %v instead of a conflict", tt.name, p, err)
+			} else if e.Existing != first.ID {
+				t.Errorf("%s: conflict names %s instead of %s", tt.name, e.Existing, first.ID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if p.Refs != tt.refs {
+			t.Errorf("%s: got %d references, want %d", tt.name, p.Refs, tt.refs)
+		}
+	}
+
+	// Overlapping pools are fine once the last reference is gone
+	for i := 0; i < 2; i++ {
+		if err := ps.release(first.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ps.get(first.ID); err == nil {
+		t.Errorf("pool %s still stored", first.ID)
+	}
+	if _, err := ps.acquire(newTestPool(t, "10.1.0.0/25", nil)); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+}
+
+func TestPoolsShared(t *testing.T) {
+	ps, dir := newTestPools(t)
+	defer os.RemoveAll(dir)
+	// Another host sharing the store
+	other := poolsNew(LocalSpace, ps.store)
+	p, err := ps.acquire(newTestPool(t, "10.1.0.0/24", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.get(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.acquire(newTestPool(t, "10.1.0.0/24", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := ps.get(p.ID); err != nil {
+		t.Fatal(err)
+	} else if cur.Refs != 2 {
+		t.Errorf("got %d references, want 2", cur.Refs)
+	}
+	if err := other.release(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := ps.get(p.ID); err != nil {
+		t.Fatal(err)
+	} else if cur.Refs != 1 {
+		t.Errorf("got %d references after release, want 1", cur.Refs)
+	}
+}
+
+func TestPoolsName(t *testing.T) {
+	ps, dir := newTestPools(t)
+	defer os.RemoveAll(dir)
+	c := newClient("eth0", nil, timing{})
+	p, err := ps.acquire(newTestPool(t, "10.1.0.0/24", map[string]string{optVlan: "72", optNetwork: "web"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.circuitID(p); got != "vlan72:web" {
+		t.Errorf("circuit ID before the network was created: got %q", got)
+	}
+
+	// Pools of other subnets stay as they are, and the first network wins
+	for _, name := range []struct {
+		subnet  string
+		network string
+	}{{"10.2.0.0/24", "n0"}, {"10.1.0.0/24", "n1"}, {"10.1.0.0/24", "n2"}} {
+		if err := ps.name(mustCIDR(t, name.subnet), name.network); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p, err = ps.get(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if p.NetworkID != "n1" {
+		t.Errorf("got network %q, want n1", p.NetworkID)
+	}
+	if got := c.circuitID(p); got != "vlan72:n1" {
+		t.Errorf("circuit ID after the network was created: got %q", got)
+	}
+
+	p.Vlan, p.Link, p.NetworkID, p.Network = 0, "", "", ""
+	if got := c.circuitID(p); got != "eth0:"+p.ID {
+		t.Errorf("circuit ID of an unnamed pool: got %q", got)
+	}
+}
@@ -0,0 +1,243 @@
+package ipamplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/xytis/polyp/common"
+)
+
+const (
+	restTimeout = 10 * time.Second
+	// Start of descriptions of addresses polyp allocated, nothing else is
+	// ever deleted
+	restTag = "polyp"
+)
+
+// restClient allocates addresses in an external IPAM speaking the NetBox
+// REST API. Prefixes are looked up by subnet or taken by ID, and
+// addresses are created in them with a description naming the container
+// and host, and the docker endpoint once it exists.
+type restClient struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+type restPrefix struct {
+	ID     int    `json:"id"`
+	Prefix string `json:"prefix"`
+}
+
+type restAddress struct {
+	ID          int    `json:"id,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Description string `json:"description,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+// restList is the paginated envelope of list calls
+type restList struct {
+	Count   int             `json:"count"`
+	Results json.RawMessage `json:"results"`
+}
+
+func newRestClient(url, token string) *restClient {
+	return &restClient{
+		url:   strings.TrimRight(url, "/"),
+		token: token,
+		http:  &http.Client{Timeout: restTimeout},
+	}
+}
+
+// do sends in as JSON and decodes the answer into out, either may be nil
+func (rc *restClient) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	rq, err := http.NewRequest(method, rc.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Accept", "application/json")
+	if in != nil {
+		rq.Header.Set("Content-Type", "application/json")
+	}
+	if rc.token != "" {
+		rq.Header.Set("Authorization", "Token "+rc.token)
+	}
+	res, err := rc.http.Do(rq)
+	if err != nil {
+		return fmt.Errorf("rest ipam: %v", err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	Log.Debugf("Rest ipam %s %s returned %d", method, path, res.StatusCode)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return ErrRestStatus{method, rq.URL.String(), res.StatusCode, strings.TrimSpace(string(b))}
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// list fetches the results of a list call into out
+func (rc *restClient) list(path string, query url.Values, out interface{}) (int, error) {
+	var l restList
+	if err := rc.do("GET", path+"?"+query.Encode(), nil, &l); err != nil {
+		return 0, err
+	}
+	if l.Count == 0 {
+		return 0, nil
+	}
+	return l.Count, json.Unmarshal(l.Results, out)
+}
+
+// prefix returns the prefix of the given ID
+func (rc *restClient) prefix(id int) (*net.IPNet, error) {
+	var p restPrefix
+	if err := rc.do("GET", "/api/ipam/prefixes/"+strconv.Itoa(id)+"/", nil, &p); err != nil {
+		if e, ok := err.(ErrRestStatus); ok && e.Status == http.StatusNotFound {
+			return nil, ErrNoPool("rest prefix " + strconv.Itoa(id))
+		}
+		return nil, err
+	}
+	_, subnet, err := net.ParseCIDR(p.Prefix)
+	return subnet, err
+}
+
+// prefixOf returns the ID of the prefix of subnet
+func (rc *restClient) prefixOf(subnet *net.IPNet) (int, error) {
+	var ps []restPrefix
+	n, err := rc.list("/api/ipam/prefixes/", url.Values{"prefix": {subnet.String()}}, &ps)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrNoPool("rest prefix " + subnet.String())
+	}
+	if n > 1 {
+		Log.Warnf("Rest ipam knows %d prefixes of %v, using %d", n, subnet, ps[0].ID)
+	}
+	return ps[0].ID, nil
+}
+
+// addresses returns the records of ip
+func (rc *restClient) addresses(ip net.IP, mask net.IPMask) ([]restAddress, error) {
+	var as []restAddress
+	address := (&net.IPNet{IP: ip, Mask: mask}).String()
+	_, err := rc.list("/api/ipam/ip-addresses/", url.Values{"address": {address}}, &as)
+	return as, err
+}
+
+// assign allocates want, or the next free address of the prefix of p,
+// for the container known by id
+func (rc *restClient) assign(p *pool, mac net.HardwareAddr, id identity, want net.IP, host string) (*lease, error) {
+	container := id.Hostname
+	if container == "" {
+		container = mac.String()
+	}
+	a := restAddress{
+		Description: fmt.Sprintf("%s container=%s host=%s", restTag, container, host),
+		Status:      "active",
+	}
+	if want != nil {
+		if as, err := rc.addresses(want, p.Subnet.Mask); err != nil {
+			return nil, err
+		} else if len(as) > 0 {
+			return nil, ErrAddressInUse(want.String())
+		}
+		a.Address = (&net.IPNet{IP: want, Mask: p.Subnet.Mask}).String()
+		if err := rc.do("POST", "/api/ipam/ip-addresses/", a, &a); err != nil {
+			return nil, err
+		}
+	} else if err := rc.do("POST", "/api/ipam/prefixes/"+strconv.Itoa(p.Prefix)+"/available-ips/", a, &a); err != nil {
+		// NetBox refuses with a conflict once the prefix is full
+		if e, ok := err.(ErrRestStatus); ok && (e.Status == http.StatusConflict || e.Status == http.StatusNoContent) {
+			return nil, ErrPoolExhausted(p.Subnet.String())
+		}
+		return nil, err
+	}
+	ip, _, err := net.ParseCIDR(a.Address)
+	if err != nil {
+		return nil, fmt.Errorf("rest ipam allocated unparseable address %q", a.Address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &lease{
+		MAC:   mac,
+		IP:    ip,
+		Mask:  p.Subnet.Mask,
+		Start: time.Now(),
+		State: leaseRest,
+		Data:  map[string]string{},
+	}, nil
+}
+
+// reserve records ip as taken by what, unless the external IPAM knows it
+// already, e.g. as the gateway of the prefix
+func (rc *restClient) reserve(ip net.IP, mask net.IPMask, what string) error {
+	if as, err := rc.addresses(ip, mask); err != nil || len(as) > 0 {
+		return err
+	}
+	a := restAddress{
+		Address:     (&net.IPNet{IP: ip, Mask: mask}).String(),
+		Description: restTag + " " + what,
+		Status:      "reserved",
+	}
+	return rc.do("POST", "/api/ipam/ip-addresses/", a, nil)
+}
+
+// tag adds the docker endpoint to the records polyp created for ip. Docker
+// creates endpoints only after their addresses, so records start without.
+func (rc *restClient) tag(ip net.IP, mask net.IPMask, endpoint string) error {
+	as, err := rc.addresses(ip, mask)
+	if err != nil {
+		return err
+	}
+	for _, a := range as {
+		if !strings.HasPrefix(a.Description, restTag+" ") || a.Status == "reserved" {
+			continue
+		}
+		patch := restAddress{Description: a.Description + " endpoint=" + endpoint}
+		if err := rc.do("PATCH", "/api/ipam/ip-addresses/"+strconv.Itoa(a.ID)+"/", patch, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release deletes the records polyp created for ip
+func (rc *restClient) release(ip net.IP, mask net.IPMask) error {
+	as, err := rc.addresses(ip, mask)
+	if err != nil {
+		return err
+	}
+	for _, a := range as {
+		if !strings.HasPrefix(a.Description, restTag+" ") {
+			Log.Warnf("Leaving rest ipam address %d of %v, which polyp did not create", a.ID, ip)
+			continue
+		}
+		if err := rc.do("DELETE", "/api/ipam/ip-addresses/"+strconv.Itoa(a.ID)+"/", nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
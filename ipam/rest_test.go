@@ -0,0 +1,326 @@
+package ipamplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ipamapi "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libnetwork/netlabel"
+
+	. "github.com/xytis/polyp/common"
+)
+
+const testToken = "secret"
+
+// netbox stands in for the external IPAM, knowing prefix 7 of 10.60.0.0/29
+type netbox struct {
+	sync.Mutex
+	addresses map[int]restAddress
+	next      int
+}
+
+func newTestNetbox() (*netbox, *httptest.Server) {
+	nb := &netbox{addresses: map[int]restAddress{}, next: 100}
+	return nb, httptest.NewServer(nb)
+}
+
+func (nb *netbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nb.Lock()
+	defer nb.Unlock()
+	if r.Header.Get("Authorization") != "Token "+testToken {
+		http.Error(w, `{"detail":"Invalid token"}`, http.StatusForbidden)
+		return
+	}
+	list := func(results interface{}, n int) {
+		b, _ := json.Marshal(results)
+		json.NewEncoder(w).Encode(restList{Count: n, Results: b})
+	}
+	var in restAddress
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&in)
+	}
+	path, id := r.URL.Path, 0
+	if s := strings.TrimPrefix(path, "/api/ipam/ip-addresses/"); s != path && s != "" {
+		id, _ = strconv.Atoi(strings.TrimSuffix(s, "/"))
+		path = "/api/ipam/ip-addresses/<id>/"
+	}
+	switch r.Method + " " + path {
+	case "GET /api/ipam/prefixes/":
+		if r.URL.Query().Get("prefix") == "10.60.0.0/29" {
+			list([]restPrefix{{7, "10.60.0.0/29"}}, 1)
+		} else {
+			list([]restPrefix{}, 0)
+		}
+	case "GET /api/ipam/prefixes/7/":
+		json.NewEncoder(w).Encode(restPrefix{7, "10.60.0.0/29"})
+	case "POST /api/ipam/prefixes/7/available-ips/":
+		for k := 1; k < 7; k++ {
+			if in.Address = fmt.Sprintf("10.60.0.%d/29", k); len(nb.find(in.Address)) == 0 {
+				nb.create(w, in)
+				return
+			}
+		}
+		http.Error(w, `{"detail":"An insufficient number of IP addresses are available"}`, http.StatusConflict)
+	case "GET /api/ipam/ip-addresses/":
+		as := nb.find(r.URL.Query().Get("address"))
+		list(as, len(as))
+	case "POST /api/ipam/ip-addresses/":
+		nb.create(w, in)
+	case "PATCH /api/ipam/ip-addresses/<id>/":
+		a := nb.addresses[id]
+		a.Description = in.Description
+		nb.addresses[id] = a
+		json.NewEncoder(w).Encode(a)
+	case "DELETE /api/ipam/ip-addresses/<id>/":
+		delete(nb.addresses, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (nb *netbox) create(w http.ResponseWriter, a restAddress) {
+	nb.next++
+	a.ID = nb.next
+	nb.addresses[a.ID] = a
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func (nb *netbox) find(address string) []restAddress {
+	res := []restAddress{}
+	for _, a := range nb.addresses {
+		if a.Address == address {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+func (nb *netbox) count(address string) int {
+	nb.Lock()
+	defer nb.Unlock()
+	return len(nb.find(address))
+}
+
+// description returns the description of the only record of address
+func (nb *netbox) description(t *testing.T, address string) string {
+	nb.Lock()
+	defer nb.Unlock()
+	as := nb.find(address)
+	if len(as) != 1 {
+		t.Fatalf("%d records of %s", len(as), address)
+	}
+	return as[0].Description
+}
+
+// newTestRestIpam returns an ipam keeping its local space in a new
+// temporary directory, which the caller removes
+func newTestRestIpam(t *testing.T, url, token string) (*ipam, string) {
+	st, dir := newTestStore(t)
+	c := newClient("lo", nil, timing{})
+	rc := newRestClient(url, token)
+	return &ipam{
+		client: c,
+		rest:   rc,
+		spaces: map[string]*space{LocalSpace: spaceNew(LocalSpace, c, rc, "host1", st)},
+	}, dir
+}
+
+func requestRest(i *ipam, pool, mac, address, hostname string) (string, error) {
+	res, err := i.RequestAddress(&ipamapi.RequestAddressRequest{
+		PoolID:  pool,
+		Address: address,
+		Options: map[string]string{netlabel.MacAddress: mac, optHostname: hostname},
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.Address, nil
+}
+
+func TestRestPool(t *testing.T) {
+	_, srv := newTestNetbox()
+	defer srv.Close()
+	i, dir := newTestRestIpam(t, srv.URL+"/", testToken)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		pool    string
+		options map[string]string
+		err     bool
+	}{
+		{"by subnet", "10.60.0.0/29", nil, false},
+		{"by prefix", "", map[string]string{optPrefix: "7"}, false},
+		{"unknown subnet", "10.61.0.0/24", nil, true},
+		{"unknown prefix", "", map[string]string{optPrefix: "8"}, true},
+	}
+	for _, tt := range tests {
+		options := map[string]string{optMode: modeRest}
+		for k, v := range tt.options {
+			options[k] = v
+		}
+		res, err := i.RequestPool(&ipamapi.RequestPoolRequest{AddressSpace: LocalSpace, Pool: tt.pool, Options: options})
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got pool %v", tt.name, res.Pool)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if res.Pool != "10.60.0.0/29" {
+			t.Errorf("%s: got pool %s", tt.name, res.Pool)
+		}
+	}
+}
+
+func TestRestAddresses(t *testing.T) {
+	nb, srv := newTestNetbox()
+	defer srv.Close()
+	i, dir := newTestRestIpam(t, srv.URL, testToken)
+	defer os.RemoveAll(dir)
+	pool, err := i.RequestPool(&ipamapi.RequestPoolRequest{
+		AddressSpace: LocalSpace,
+		Pool:         "10.60.0.0/29",
+		Options:      map[string]string{optMode: modeRest},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway is reserved on behalf of the network
+	gw, err := i.RequestAddress(&ipamapi.RequestAddressRequest{
+		PoolID:  pool.PoolID,
+		Options: map[string]string{requestAddressType: netlabel.Gateway},
+	})
+	if err != nil || gw.Address != "10.60.0.1/29" {
+		t.Fatalf("gateway: %v, %v", gw, err)
+	}
+	if d := nb.description(t, "10.60.0.1/29"); d != "polyp "+netlabel.Gateway {
+		t.Errorf("gateway described as %q", d)
+	}
+
+	// A record polyp did not create survives releases
+	nb.Lock()
+	nb.addresses[1] = restAddress{ID: 1, Address: "10.60.0.6/29", Description: "printer"}
+	nb.Unlock()
+
+	tests := []struct {
+		mac     string
+		address string
+		got     string
+		err     error
+	}{
+		{"02:00:00:00:00:01", "", "10.60.0.2/29", nil},
+		{"02:00:00:00:00:02", "10.60.0.5", "10.60.0.5/29", nil},
+		{"02:00:00:00:00:03", "10.60.0.5", "", ErrAddressInUse("10.60.0.5")},
+		{"02:00:00:00:00:04", "10.60.0.6", "", ErrAddressInUse("10.60.0.6")},
+		{"02:00:00:00:00:05", "", "10.60.0.3/29", nil},
+		{"02:00:00:00:00:06", "", "10.60.0.4/29", nil},
+		// The prefix is full, NetBox refuses with a conflict
+		{"02:00:00:00:00:07", "", "", ErrPoolExhausted("10.60.0.0/29")},
+	}
+	for _, tt := range tests {
+		got, err := requestRest(i, pool.PoolID, tt.mac, tt.address, "")
+		if got != tt.got || err != tt.err {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.mac, got, err, tt.got, tt.err)
+		}
+	}
+	if d := nb.description(t, "10.60.0.2/29"); d != "polyp container=02:00:00:00:00:01 host=host1" {
+		t.Errorf("10.60.0.2 described as %q", d)
+	}
+
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	i.endpointCreated(mac, "ep1")
+	if d := nb.description(t, "10.60.0.2/29"); d != "polyp container=02:00:00:00:00:01 host=host1 endpoint=ep1" {
+		t.Errorf("10.60.0.2 of endpoint ep1 described as %q", d)
+	}
+
+	for _, ip := range []string{"10.60.0.2", "10.60.0.1", "10.60.0.6"} {
+		if err := i.ReleaseAddress(&ipamapi.ReleaseAddressRequest{PoolID: pool.PoolID, Address: ip}); err != nil {
+			t.Errorf("releasing %s: %v", ip, err)
+		}
+	}
+	if nb.count("10.60.0.2/29") != 0 || nb.count("10.60.0.1/29") != 0 {
+		t.Error("released records still exist")
+	}
+	if nb.count("10.60.0.6/29") != 1 {
+		t.Error("foreign record deleted")
+	}
+	if got, err := requestRest(i, pool.PoolID, "02:00:00:00:00:08", "", "web"); err != nil || got != "10.60.0.1/29" {
+		t.Errorf("after release: got %q, %v", got, err)
+	}
+	if d := nb.description(t, "10.60.0.1/29"); d != "polyp container=web host=host1" {
+		t.Errorf("10.60.0.1 described as %q", d)
+	}
+}
+
+// The gateway of a pool shared by two networks stays reserved until the
+// last of them is gone
+func TestRestSharedGateway(t *testing.T) {
+	nb, srv := newTestNetbox()
+	defer srv.Close()
+	i, dir := newTestRestIpam(t, srv.URL, testToken)
+	defer os.RemoveAll(dir)
+	rq := &ipamapi.RequestPoolRequest{
+		AddressSpace: LocalSpace,
+		Pool:         "10.60.0.0/29",
+		Options:      map[string]string{optMode: modeRest},
+	}
+	var pool *ipamapi.RequestPoolResponse
+	for n := 0; n < 2; n++ {
+		var err error
+		if pool, err = i.RequestPool(rq); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = i.RequestAddress(&ipamapi.RequestAddressRequest{
+			PoolID:  pool.PoolID,
+			Options: map[string]string{requestAddressType: netlabel.Gateway},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release := func() {
+		if err := i.ReleaseAddress(&ipamapi.ReleaseAddressRequest{PoolID: pool.PoolID, Address: "10.60.0.1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.ReleasePool(&ipamapi.ReleasePoolRequest{PoolID: pool.PoolID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release()
+	if nb.count("10.60.0.1/29") != 1 {
+		t.Error("gateway released while the pool is still shared")
+	}
+	release()
+	if nb.count("10.60.0.1/29") != 0 {
+		t.Error("gateway kept after the last release")
+	}
+}
+
+func TestRestErrorStatus(t *testing.T) {
+	_, srv := newTestNetbox()
+	defer srv.Close()
+	i, dir := newTestRestIpam(t, srv.URL, "wrong")
+	defer os.RemoveAll(dir)
+	_, err := i.RequestPool(&ipamapi.RequestPoolRequest{
+		AddressSpace: LocalSpace,
+		Pool:         "10.60.0.0/29",
+		Options:      map[string]string{optMode: modeRest},
+	})
+	e, ok := err.(ErrRestStatus)
+	if !ok {
+		t.Fatalf("got %v instead of a status error", err)
+	}
+	if e.Method != "GET" || e.Status != http.StatusForbidden || !strings.Contains(e.Body, "Invalid token") {
+		t.Errorf("got %+v", e)
+	}
+}
@@ -0,0 +1,213 @@
+package ipamplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/xytis/polyp/common"
+)
+
+// ICMPv6 neighbor discovery (RFC 4861)
+const (
+	icmpRouterSolicitation  = 133
+	icmpRouterAdvertisement = 134
+
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	// Recursive DNS servers (RFC 8106)
+	ndOptRDNSS = 25
+
+	raFlagManaged    = 0x80
+	prefixFlagOnLink = 0x80
+	prefixFlagAuto   = 0x40
+)
+
+// allRouters is the multicast group routers of a link listen on
+var allRouters = net.ParseIP("ff02::2")
+
+// routerAdvert is what a router told about the link
+type routerAdvert struct {
+	Router net.IP
+	// Addresses are to be leased by DHCPv6
+	Managed  bool
+	Prefixes []raPrefix
+	DNS      []net.IP
+}
+
+type raPrefix struct {
+	*net.IPNet
+	OnLink     bool
+	Autonomous bool
+}
+
+// solicitRouter sends router solicitations on ifi until a router
+// advertises itself
+func solicitRouter(ifi *net.Interface, t timing) (*routerAdvert, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return nil, fmt.Errorf("could not open icmpv6 socket: %v", err)
+	}
+	if err := setupICMP6(fd, ifi.Name); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "icmp6-"+ifi.Name)
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// The kernel fills in the checksum of ICMPv6 raw sockets. Without a
+	// link local address the solicitation leaves from the unspecified
+	// address, which must not come with our link-layer address (RFC 4861
+	// 4.1).
+	rs := []byte{icmpRouterSolicitation, 0, 0, 0, 0, 0, 0, 0}
+	if len(ifi.HardwareAddr) == 6 && linkLocal(ifi) != nil {
+		rs = append(rs, ndOptSourceLinkAddr, 1)
+		rs = append(rs, ifi.HardwareAddr...)
+	}
+	dst := &net.IPAddr{IP: allRouters, Zone: ifi.Name}
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(t.Timeout)
+	for interval := t.Retransmit; time.Now().Before(deadline); interval = backoff(interval, t.Backoff) {
+		Log.Debugf("Sending router solicitation on %s", ifi.Name)
+		if _, err := c.WriteTo(rs, dst); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(interval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		if err := c.SetReadDeadline(wait); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			ra, err := parseRouterAdvert(buf[:n])
+			if err != nil || ra == nil {
+				continue
+			}
+			ra.Router = from.(*net.IPAddr).IP
+			Log.Debugf("Received router advertisement from %v on %s", ra.Router, ifi.Name)
+			return ra, nil
+		}
+	}
+	return nil, ErrDhcpTimeout("router advertisement")
+}
+
+func setupICMP6(fd int, iface string) error {
+	// Routers ignore solicitations which crossed a router (RFC 4861 6.1.1)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return fmt.Errorf("could not set IPV6_MULTICAST_HOPS: %v", err)
+	}
+	if err := syscall.BindToDevice(fd, iface); err != nil {
+		return fmt.Errorf("could not bind icmpv6 socket to %s: %v", iface, err)
+	}
+	return nil
+}
+
+// parseRouterAdvert decodes an ICMPv6 message, returning nil for anything
+// but router advertisements
+func parseRouterAdvert(b []byte) (*routerAdvert, error) {
+	if len(b) < 16 || b[0] != icmpRouterAdvertisement || b[1] != 0 {
+		return nil, nil
+	}
+	ra := &routerAdvert{Managed: b[5]&raFlagManaged != 0}
+	for opts := b[16:]; len(opts) > 0; {
+		if len(opts) < 2 || opts[1] == 0 || len(opts) < 8*int(opts[1]) {
+			return nil, fmt.Errorf("malformed router advertisement option")
+		}
+		opt := opts[:8*int(opts[1])]
+		opts = opts[len(opt):]
+		switch opt[0] {
+		case ndOptPrefixInfo:
+			if len(opt) < 32 || opt[2] > 128 {
+				continue
+			}
+			ip := append(net.IP(nil), opt[16:32]...)
+			mask := net.CIDRMask(int(opt[2]), 128)
+			ra.Prefixes = append(ra.Prefixes, raPrefix{
+				IPNet:      &net.IPNet{IP: ip.Mask(mask), Mask: mask},
+				OnLink:     opt[3]&prefixFlagOnLink != 0,
+				Autonomous: opt[3]&prefixFlagAuto != 0,
+			})
+		case ndOptRDNSS:
+			if binary.BigEndian.Uint32(opt[4:8]) == 0 {
+				// Lifetime 0 withdraws the servers
+				continue
+			}
+			for ips := opt[8:]; len(ips) >= 16; ips = ips[16:] {
+				ra.DNS = append(ra.DNS, append(net.IP(nil), ips[:16]...))
+			}
+		}
+	}
+	return ra, nil
+}
+
+// probe6 asks routers what the network on the link of p looks like and
+// which name servers it uses. Slaac pools take the first prefix for
+// autonomous configuration, others the first on-link prefix.
+func (c *client) probe6(p *pool) (*net.IPNet, []net.IP, error) {
+	ifi, err := c.link(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	ra, err := solicitRouter(ifi, c.timingOf(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Mode == modeDHCP && !ra.Managed {
+		Log.Warnf("Router %v does not advertise DHCPv6 on %s", ra.Router, ifi.Name)
+	}
+	for _, prefix := range ra.Prefixes {
+		ones, _ := prefix.Mask.Size()
+		if p.Mode == modeSlaac && prefix.Autonomous && ones == 64 || p.Mode != modeSlaac && prefix.OnLink {
+			return prefix.IPNet, ra.DNS, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("router %v advertised no prefix usable for %s pools", ra.Router, p.Mode)
+}
+
+// slaacLease computes the address mac configures for itself in the /64
+// subnet of p, its interface identifier is the modified EUI-64 of mac
+// (RFC 4291 appendix A)
+func slaacLease(p *pool, mac net.HardwareAddr) (*lease, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("can not derive an interface identifier of %v", mac)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.Subnet.IP.To16()[:8])
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	l := &lease{
+		MAC:   mac,
+		IP:    ip,
+		Mask:  p.Subnet.Mask,
+		Start: time.Now(),
+		State: leaseSlaac,
+		Data:  map[string]string{},
+	}
+	if len(p.DNS) > 0 {
+		dns := make([]string, len(p.DNS))
+		for i, ip := range p.DNS {
+			dns[i] = ip.String()
+		}
+		l.Data[DataDNS] = strings.Join(dns, ",")
+	}
+	return l, nil
+}
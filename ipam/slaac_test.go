@@ -0,0 +1,106 @@
+package ipamplugin
+
+import (
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSlaacLease(t *testing.T) {
+	p := &pool{
+		Subnet: mustCIDR(t, "2001:db8:1::/64"),
+		DNS:    []net.IP{net.ParseIP("2001:db8:1::53")},
+	}
+	tests := []struct {
+		mac string
+		ip  string
+	}{
+		// RFC 4291 appendix A, the universal bit gets inverted
+		{"00:25:96:12:34:56", "2001:db8:1:0:225:96ff:fe12:3456"},
+		{"02:42:ac:11:00:02", "2001:db8:1:0:42:acff:fe11:2"},
+	}
+	for _, tt := range tests {
+		mac, _ := net.ParseMAC(tt.mac)
+		l, err := slaacLease(p, mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !l.IP.Equal(net.ParseIP(tt.ip)) || l.address(nil).String() != tt.ip+"/64" {
+			t.Errorf("%s: got %v, want %s", tt.mac, l.address(nil), tt.ip)
+		}
+		if l.State != leaseSlaac || l.Data[DataDNS] != "2001:db8:1::53" {
+			t.Errorf("%s: got lease %+v", tt.mac, l)
+		}
+	}
+	if _, err := slaacLease(p, net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8}); err == nil {
+		t.Error("expected an error for an 8 byte MAC")
+	}
+}
+
+// Router advertisement laid out as radvd sends it, as read from an ICMPv6
+// socket
+const radvdRA = "86 00 4c 3b 40 80 07 08 00 00 00 00 00 00 00 00" +
+	// Source link-layer address
+	" 01 01 02 42 0a 09 00 fe" +
+	// MTU
+	" 05 01 00 00 00 00 05 dc" +
+	// Prefix 2001:db8:1::/64, on-link and autonomous
+	" 03 04 40 c0 00 27 8d 00 00 09 3a 80 00 00 00 00" +
+	" 20 01 0d b8 00 01 00 00 00 00 00 00 00 00 00 00" +
+	// Prefix 2001:db8:2::/48, on-link only
+	" 03 04 30 80 00 27 8d 00 00 09 3a 80 00 00 00 00" +
+	" 20 01 0d b8 00 02 00 00 00 00 00 00 00 00 00 00" +
+	// Name servers 2001:db8:1::53 and 2001:db8:1::54
+	" 19 05 00 00 00 00 07 08" +
+	" 20 01 0d b8 00 01 00 00 00 00 00 00 00 00 00 53" +
+	" 20 01 0d b8 00 01 00 00 00 00 00 00 00 00 00 54"
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseRouterAdvert(t *testing.T) {
+	ra, err := parseRouterAdvert(mustHex(t, radvdRA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &routerAdvert{
+		Managed: true,
+		Prefixes: []raPrefix{
+			{mustCIDR(t, "2001:db8:1::/64"), true, true},
+			{mustCIDR(t, "2001:db8:2::/48"), true, false},
+		},
+		DNS: []net.IP{net.ParseIP("2001:db8:1::53"), net.ParseIP("2001:db8:1::54")},
+	}
+	if !reflect.DeepEqual(ra, want) {
+		t.Errorf("got %+v, want %+v", ra, want)
+	}
+
+	tests := []struct {
+		name string
+		b    string
+		ra   *routerAdvert
+		err  bool
+	}{
+		{"solicitation", "85 00 00 00 00 00 00 00", nil, false},
+		{"short", "86 00 4c 3b 40 80 07 08", nil, false},
+		{"no options", "86 00 4c 3b 40 00 07 08 00 00 00 00 00 00 00 00", &routerAdvert{}, false},
+		// Lifetime 0 withdraws name servers
+		{"withdrawn servers", "86 00 4c 3b 40 00 07 08 00 00 00 00 00 00 00 00" +
+			" 19 03 00 00 00 00 00 00 20 01 0d b8 00 01 00 00 00 00 00 00 00 00 00 53", &routerAdvert{}, false},
+		{"zero option length", "86 00 4c 3b 40 00 07 08 00 00 00 00 00 00 00 00 01 00 02 42 0a 09 00 fe", nil, true},
+		{"truncated option", "86 00 4c 3b 40 00 07 08 00 00 00 00 00 00 00 00 03 04 40 c0", nil, true},
+	}
+	for _, tt := range tests {
+		ra, err := parseRouterAdvert(mustHex(t, tt.b))
+		if (err != nil) != tt.err || !reflect.DeepEqual(ra, tt.ra) {
+			t.Errorf("%s: got %+v, %v", tt.name, ra, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package ipamplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/libkv/store"
+)
+
+// space holds the pools and leases of an address space. The local space
+// keeps them in a store of this host, the global one in the cluster store
+// shared with other hosts.
+type space struct {
+	name   string
+	store  store.Store
+	client *client
+	// External IPAM of rest pools, nil when not configured
+	rest   *restClient
+	pools  *pools
+	leases *leases
+	blocks *blocks
+}
+
+func spaceNew(name string, c *client, rc *restClient, host string, st store.Store) *space {
+	ps := poolsNew(name, st)
+	return &space{
+		name:   name,
+		store:  st,
+		client: c,
+		rest:   rc,
+		pools:  ps,
+		leases: leasesNew(c, ps, host, st),
+		blocks: blocksNew(),
+	}
+}
+
+// space returns the address space of the given name
+func (i *ipam) space(name string) (*space, error) {
+	sp, ok := i.spaces[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown address space %q", name)
+	}
+	return sp, nil
+}
+
+// spaceOf returns the address space a pool ID belongs to. IDs handed out
+// before spaces were told apart belong to the global one.
+func (i *ipam) spaceOf(id string) *space {
+	if strings.HasPrefix(id, LocalSpace+"-") {
+		return i.spaces[LocalSpace]
+	}
+	return i.spaces[GlobalSpace]
+}
+
+// release gives l back to wherever it came from
+func (sp *space) release(p *pool, l *lease) error {
+	if l.State == leaseFallback || l.State == leaseStatic {
+		if p == nil {
+			return fmt.Errorf("pool of %s address %v unknown", l.State, l.IP)
+		}
+		if l.State == leaseStatic && p.Block != 0 {
+			return sp.blockFree(p, l.IP)
+		}
+		return sp.unclaim(p.Subnet, l.IP)
+	}
+	if l.State == leaseRest {
+		if sp.rest == nil {
+			return fmt.Errorf("no rest ipam configured to release %v in", l.IP)
+		}
+		return sp.rest.release(l.IP, l.Mask)
+	}
+	if l.State == leaseSlaac {
+		return nil
+	}
+	if l.IP.To4() == nil {
+		return sp.client.release6(p, l)
+	}
+	return sp.client.release(p, l)
+}
+
+// overlaps reports whether two networks share addresses
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
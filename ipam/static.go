@@ -0,0 +1,210 @@
+package ipamplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/docker/libkv/store"
+	"github.com/docker/libnetwork/netlabel"
+	. "github.com/xytis/polyp/common"
+)
+
+// Owner of auxiliary addresses claimed, gateways are owned by
+// netlabel.Gateway and others by the MAC address they are leased to
+const ownerAuxiliary = "auxiliary"
+
+func _addresses(subnet *net.IPNet) string {
+	return "polyp/address/" + url.QueryEscape(subnet.String())
+}
+
+func _address(subnet *net.IPNet, ip net.IP) string {
+	return _addresses(subnet) + "/" + ip.String()
+}
+
+// assign hands out an address of r to mac without DHCP. The lease never
+// expires and is kept in state.
+func (sp *space) assign(p *pool, r *net.IPNet, mac net.HardwareAddr, want net.IP, state string) (*lease, error) {
+	var (
+		ip  net.IP
+		err error
+	)
+	if state == leaseStatic && p.Block != 0 {
+		ip, err = sp.blockAssign(p, want, mac.String())
+	} else {
+		ip, err = sp.claim(p, r, want, mac.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lease{
+		MAC:   mac,
+		IP:    ip,
+		Mask:  p.Subnet.Mask,
+		Start: time.Now(),
+		State: state,
+		Data:  map[string]string{},
+	}, nil
+}
+
+// claim takes want, or the first free address of r allowed in p, for
+// owner.
+func (sp *space) claim(p *pool, r *net.IPNet, want net.IP, owner string) (net.IP, error) {
+	return Claim(sp.store, p.Subnet, r, want, owner, p.allowed)
+}
+
+// claimShared claims ip for the gateway or an auxiliary address, which
+// another network sharing p may have done before
+func (sp *space) claimShared(p *pool, ip net.IP, owner string) error {
+	_, err := sp.claim(p, p.Subnet, ip, owner)
+	if _, ok := err.(ErrAddressInUse); ok {
+		if pair, gerr := sp.store.Get(_address(p.Subnet, ip)); gerr == nil && string(pair.Value) == owner {
+			return nil
+		}
+	}
+	return err
+}
+
+// unclaimShared frees ip unless it is the gateway or an auxiliary address
+// and other networks still hold references on p
+func (sp *space) unclaimShared(p *pool, ip net.IP) error {
+	pair, err := sp.store.Get(_address(p.Subnet, ip))
+	if err == store.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if owner := string(pair.Value); owner == netlabel.Gateway || owner == ownerAuxiliary {
+		if shared, err := sp.shared(p); err != nil {
+			return err
+		} else if shared {
+			Log.Debugf("Keeping %s address %v of shared pool %s", owner, ip, p.ID)
+			return nil
+		}
+	}
+	return sp.unclaim(p.Subnet, ip)
+}
+
+// shared reports whether other networks still hold references on p, going
+// by its current record rather than the one the caller read
+func (sp *space) shared(p *pool) (bool, error) {
+	cur, err := sp.pools.get(p.ID)
+	if _, ok := err.(ErrNoPool); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return cur.Refs > 1, nil
+}
+
+// Claim takes want, or the first free address of r for which allowed
+// holds, for owner. Every address is a record in the shared store which is
+// only ever created atomically, so hosts allocating at the same time never
+// collide.
+func Claim(st store.Store, subnet, r *net.IPNet, want net.IP, owner string, allowed func(net.IP) bool) (net.IP, error) {
+	if want != nil {
+		ok, _, err := st.AtomicPut(_address(subnet, want), []byte(owner), nil, nil)
+		if err == store.ErrKeyExists || (err == nil && !ok) {
+			return nil, ErrAddressInUse(want.String())
+		} else if err != nil {
+			return nil, fmt.Errorf("could not claim %v in store: %v", want, err)
+		}
+		return want, nil
+	}
+	taken, err := claimed(st, subnet)
+	if err != nil {
+		return nil, err
+	}
+	hs := hosts(subnet, r)
+	for ip := hs.next(); ip != nil; ip = hs.next() {
+		if taken[ip.String()] || !allowed(ip) {
+			continue
+		}
+		ok, _, err := st.AtomicPut(_address(subnet, ip), []byte(owner), nil, nil)
+		if err == store.ErrKeyExists || (err == nil && !ok) {
+			// Someone was faster
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not claim %v in store: %v", ip, err)
+		}
+		return ip, nil
+	}
+	return nil, ErrPoolExhausted(r.String())
+}
+
+// claimed returns the set of addresses of subnet claimed so far
+func claimed(st store.Store, subnet *net.IPNet) (map[string]bool, error) {
+	taken := map[string]bool{}
+	pairs, err := st.List(_addresses(subnet))
+	if err == store.ErrKeyNotFound {
+		return taken, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not list addresses of %v: %v", subnet, err)
+	}
+	for _, pair := range pairs {
+		if ip := net.ParseIP(path.Base(pair.Key)); ip != nil {
+			taken[ip.String()] = true
+		}
+	}
+	return taken, nil
+}
+
+// unclaim frees an address taken by claim
+func (sp *space) unclaim(subnet *net.IPNet, ip net.IP) error {
+	return Unclaim(sp.store, subnet, ip)
+}
+
+// Unclaim frees an address taken by Claim
+func Unclaim(st store.Store, subnet *net.IPNet, ip net.IP) error {
+	err := st.Delete(_address(subnet, ip))
+	if err == store.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// hostRange walks the addresses of a range usable in its subnet, leaving
+// out the subnet network and broadcast addresses. Addresses are made only
+// as they are asked for, ranges may be large.
+type hostRange struct {
+	cur, end           uint64
+	network, broadcast uint64
+}
+
+func hosts(subnet, r *net.IPNet) *hostRange {
+	hs := &hostRange{}
+	first := r.IP.To4()
+	if ones, bits := r.Mask.Size(); first != nil && bits == 32 {
+		hs.cur = uint64(binary.BigEndian.Uint32(first.Mask(r.Mask)))
+		hs.end = hs.cur + 1<<uint(bits-ones)
+		hs.network = uint64(binary.BigEndian.Uint32(subnet.IP.To4().Mask(subnet.Mask)))
+		hs.broadcast = uint64(binary.BigEndian.Uint32(broadcast(subnet)))
+	}
+	return hs
+}
+
+// next returns the next address of the range, nil past its end
+func (hs *hostRange) next() net.IP {
+	for ; hs.cur < hs.end; hs.cur++ {
+		if hs.cur == hs.network || hs.cur == hs.broadcast {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(hs.cur))
+		hs.cur++
+		return ip
+	}
+	return nil
+}
+
+func broadcast(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+	base := subnet.IP.To4()
+	for j := range ip {
+		ip[j] = base[j] | ^subnet.Mask[len(subnet.Mask)-4+j]
+	}
+	return ip
+}
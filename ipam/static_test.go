@@ -0,0 +1,90 @@
+package ipamplugin
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	ipamapi "github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libnetwork/netlabel"
+)
+
+func TestHosts(t *testing.T) {
+	tests := []struct {
+		subnet, r string
+		want      []string
+	}{
+		{"10.1.0.0/29", "10.1.0.0/29", []string{"10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4", "10.1.0.5", "10.1.0.6"}},
+		{"10.1.0.0/24", "10.1.0.0/30", []string{"10.1.0.1", "10.1.0.2", "10.1.0.3"}},
+		{"10.1.0.0/24", "10.1.0.252/30", []string{"10.1.0.252", "10.1.0.253", "10.1.0.254"}},
+		{"10.1.0.0/23", "10.1.0.254/31", []string{"10.1.0.254", "10.1.0.255"}},
+		{"10.1.0.0/24", "10.1.0.7/32", []string{"10.1.0.7"}},
+		{"2001:db8::/64", "2001:db8::/120", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		hs := hosts(mustCIDR(t, tt.subnet), mustCIDR(t, tt.r))
+		for ip := hs.next(); ip != nil; ip = hs.next() {
+			got = append(got, ip.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hosts(%s, %s) = %v, want %v", tt.subnet, tt.r, got, tt.want)
+		}
+	}
+
+	// Large ranges are walked only as far as needed
+	hs := hosts(mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "10.0.0.0/8"))
+	if ip := hs.next(); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("first of 10.0.0.0/8 is %v", ip)
+	}
+}
+
+func TestStaticExcludeReserve(t *testing.T) {
+	st, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	i := newTestStaticIpam(t, st)
+	pool, err := i.RequestPool(&ipamapi.RequestPoolRequest{
+		AddressSpace: LocalSpace,
+		Pool:         "10.1.0.0/24",
+		SubPool:      "10.1.0.0/29",
+		Options: map[string]string{
+			optMode:    modeStatic,
+			optExclude: "10.1.0.1-10.1.0.2",
+			optReserve: "web:10.1.0.3",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		address  string
+		hostname string
+		got      string
+		err      bool
+	}{
+		{"next allowed", "", "", "10.1.0.4/24", false},
+		{"reservation", "", "web", "10.1.0.3/24", false},
+		{"excluded", "10.1.0.2", "", "", true},
+		{"outside of the range", "10.1.0.100", "", "10.1.0.100/24", false},
+		{"outside of the subnet", "10.2.0.1", "", "", true},
+		{"next allowed again", "", "", "10.1.0.5/24", false},
+	}
+	for k, tt := range tests {
+		options := map[string]string{netlabel.MacAddress: net.HardwareAddr{2, 0, 0, 0, 0, byte(k + 1)}.String()}
+		if tt.hostname != "" {
+			options[optHostname] = tt.hostname
+		}
+		res, err := i.RequestAddress(&ipamapi.RequestAddressRequest{PoolID: pool.PoolID, Address: tt.address, Options: options})
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.name, res.Address)
+			}
+			continue
+		}
+		if err != nil || res.Address != tt.got {
+			t.Errorf("%s: got %v, %v, want %s", tt.name, res, err, tt.got)
+		}
+	}
+}
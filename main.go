@@ -2,9 +2,9 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/codegangsta/cli"
-	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/docker/go-plugins-helpers/network"
 	. "github.com/xytis/polyp/common"
 	dipam "github.com/xytis/polyp/ipam"
@@ -35,12 +35,67 @@ func main() {
 		Usage: "cluster store for shared polyp data",
 	}
 
+	var flagLocalStore = cli.StringFlag{
+		Name:  "local-store",
+		Value: "/var/lib/polyp/local.json",
+		Usage: "file keeping state of this host only",
+	}
+
 	var flagInterface = cli.StringFlag{
 		Name:  "interface, i",
 		Value: "eth0",
 		Usage: "primary interface for vlan binds",
 	}
 
+	var flagReconcileInterval = cli.DurationFlag{
+		Name:  "reconcile-interval",
+		Value: 5 * time.Minute,
+		Usage: "how often links are checked against stored networks and endpoints, 0 to check at startup only",
+	}
+
+	var flagDhcpServer = cli.StringFlag{
+		Name:  "dhcp-server",
+		Value: "",
+		Usage: "relay DHCP to this server instead of broadcasting",
+	}
+
+	var flagDhcpRetransmit = cli.DurationFlag{
+		Name:  "dhcp-retransmit",
+		Value: 2 * time.Second,
+		Usage: "wait before retransmitting an unanswered DHCP message",
+	}
+
+	var flagDhcpBackoff = cli.Float64Flag{
+		Name:  "dhcp-backoff",
+		Value: 2,
+		Usage: "factor the wait between DHCP retransmits grows by",
+	}
+
+	var flagDhcpTimeout = cli.DurationFlag{
+		Name:  "dhcp-timeout",
+		Value: 10 * time.Second,
+		Usage: "give up on a DHCP server after this long",
+	}
+
+	var flagDhcpAgentID = cli.StringFlag{
+		Name:  "dhcp-agent-id",
+		Value: "",
+		Usage: "remote ID sent to DHCP servers in relay agent information, the host name by default",
+	}
+
+	var flagRestURL = cli.StringFlag{
+		Name:  "rest-url",
+		Value: "",
+		Usage: "external IPAM (NetBox API) allocating addresses of rest pools",
+	}
+
+	var flagRestToken = cli.StringFlag{
+		Name:   "rest-token",
+		Value:  "",
+		Usage:  "API token for the external IPAM",
+		EnvVar: "POLYP_REST_TOKEN",
+	}
+
 	app := cli.NewApp()
 	app.Name = "polyp"
 	app.Usage = "Docker dhcp enabled Networking"
@@ -50,7 +105,16 @@ func main() {
 		flagNoIPAM,
 		flagNoNet,
 		flagClusterStore,
+		flagLocalStore,
 		flagInterface,
+		flagReconcileInterval,
+		flagDhcpServer,
+		flagDhcpRetransmit,
+		flagDhcpBackoff,
+		flagDhcpTimeout,
+		flagDhcpAgentID,
+		flagRestURL,
+		flagRestToken,
 	}
 
 	app.Action = Run
@@ -70,31 +134,48 @@ func Run(ctx *cli.Context) {
 	if err != nil {
 		panic(err)
 	}
+	local, err := NewFileStore(ctx.String("local-store"))
+	if err != nil {
+		panic(err)
+	}
 
-	if !ctx.Bool("no-network") {
-		d, err := dnet.NewDriver("global", ctx.String("interface"), store)
+	// Let the IPAM know of what the network driver created
+	var hooks dnet.Hooks
+	if !ctx.Bool("no-ipam") {
+		i, err := dipam.NewIpam(dipam.Config{
+			Interface:  ctx.String("interface"),
+			Server:     ctx.String("dhcp-server"),
+			Retransmit: ctx.Duration("dhcp-retransmit"),
+			Backoff:    ctx.Float64("dhcp-backoff"),
+			Timeout:    ctx.Duration("dhcp-timeout"),
+			AgentID:    ctx.String("dhcp-agent-id"),
+			RestURL:    ctx.String("rest-url"),
+			RestToken:  ctx.String("rest-token"),
+		}, store, local)
 		if err != nil {
 			panic(err)
 		}
-		h := network.NewHandler(d)
-		derr = make(chan error)
+		hooks.Network = dipam.NetworkHook(i)
+		hooks.Endpoint = dipam.EndpointHook(i)
+		h := dipam.NewHandler(i)
+		ierr = make(chan error)
 		go func() {
-			derr <- h.ServeUnix("root", "dnet")
+			ierr <- h.ServeUnix("root", "dhcp")
 		}()
-		Log.Infof("Running Driver plugin 'dnet', bound on interface %s", ctx.String("interface"))
+		Log.Infof("Running IPAM plugin 'dhcp', bound on interface %s", ctx.String("interface"))
 	}
 
-	if !ctx.Bool("no-ipam") {
-		i, err := dipam.NewIpam()
+	if !ctx.Bool("no-network") {
+		d, err := dnet.NewDriver("global", ctx.String("interface"), store, local, ctx.Duration("reconcile-interval"), hooks)
 		if err != nil {
 			panic(err)
 		}
-		h := ipam.NewHandler(i)
-		ierr = make(chan error)
+		h := network.NewHandler(d)
+		derr = make(chan error)
 		go func() {
-			ierr <- h.ServeUnix("root", "dhcp")
+			derr <- h.ServeUnix("root", "dnet")
 		}()
-		Log.Infof("Running IPAM plugin 'dhcp'")
+		Log.Infof("Running Driver plugin 'dnet', bound on interface %s", ctx.String("interface"))
 	}
 
 	if derr == nil && ierr == nil {
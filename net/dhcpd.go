@@ -0,0 +1,496 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/docker/libkv/store"
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+	"github.com/vishvananda/netlink"
+	. "github.com/xytis/polyp/common"
+	"github.com/xytis/polyp/dhcp"
+	dipam "github.com/xytis/polyp/ipam"
+)
+
+const (
+	defaultDhcpdLease = time.Hour
+	// Time declined addresses are kept from clients
+	dhcpdDeclineHold = time.Hour
+)
+
+func _dhcpdLeases(subnet *net.IPNet) string {
+	return "polyp/dhcpd/" + url.QueryEscape(subnet.String())
+}
+
+func _dhcpdLease(subnet *net.IPNet, mac net.HardwareAddr) string {
+	return _dhcpdLeases(subnet) + "/" + mac.String()
+}
+
+func _dhcpdDeclines(subnet *net.IPNet) string {
+	return "polyp/dhcpd-declined/" + url.QueryEscape(subnet.String())
+}
+
+func _dhcpdDecline(subnet *net.IPNet, ip net.IP) string {
+	return _dhcpdDeclines(subnet) + "/" + ip.String()
+}
+
+func _dhcpdServer(subnet *net.IPNet, ip net.IP) string {
+	return "polyp/dhcpd-server/" + url.QueryEscape(subnet.String()) + "/" + ip.String()
+}
+
+// dhcpdLease binds an address to a hardware address. Leases are kept in the
+// cluster store, so servers of the same VLAN on different hosts agree.
+// Declined addresses are held in the same form until they expire.
+type dhcpdLease struct {
+	IP      net.IP
+	Expires time.Time
+}
+
+// dhcpd answers DHCP on a polyp bridge for the endpoints polyp created.
+// Frames are tapped on the bridge itself, which sees broadcasts of every
+// port, as well as requests the dhcp IPAM sends through the bridge.
+//
+// The server answers from one of dhcpd-address, claimed for this host in the
+// cluster store, which the bridge gets as a host address so that unicast
+// renewals reach it. Servers of networks created before the option existed
+// answer from the gateway, and miss renewals until clients fall back to
+// broadcasting at rebinding time.
+type dhcpd struct {
+	ifi *net.Interface
+	pc  net.PacketConn
+	// Server address of this host, nil to answer from the gateway
+	addr net.IP
+	// Bound to the server address, see listenServer
+	sink   net.PacketConn
+	config networkConfig
+	// Stores registered endpoint MACs are looked up in
+	shared, local store.Store
+}
+
+func dhcpdStart(config networkConfig, shared, local store.Store) (*dhcpd, error) {
+	ifi, err := net.InterfaceByName(config.BridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("could not find bridge %s: %v", config.BridgeName, err)
+	}
+	pc, err := raw.ListenPacket(ifi, raw.Protocol(syscall.ETH_P_ALL))
+	if err != nil {
+		return nil, fmt.Errorf("could not open packet socket on %s: %v", ifi.Name, err)
+	}
+	d := &dhcpd{
+		ifi:    ifi,
+		pc:     pc,
+		config: config,
+		shared: shared,
+		local:  local,
+	}
+	if len(config.DhcpdAddresses) > 0 {
+		if d.addr, err = claimServer(shared, config); err != nil {
+			pc.Close()
+			return nil, err
+		}
+		if d.sink, err = listenServer(ifi, d.addr); err != nil {
+			shared.Delete(_dhcpdServer(config.SubnetIPv4, d.addr))
+			pc.Close()
+			return nil, err
+		}
+	}
+	go d.serve()
+	Log.Infof("Serving dhcp for %v on %s from %v", d.pool(), ifi.Name, d.address())
+	return d, nil
+}
+
+// claimServer takes a server address of config for this host. Servers of
+// the VLAN on other hosts answer from the others, as each host's bridge
+// carries its address.
+func claimServer(st store.Store, config networkConfig) (net.IP, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range config.DhcpdAddresses {
+		key := _dhcpdServer(config.SubnetIPv4, ip)
+		ok, _, err := st.AtomicPut(key, []byte(host), nil, nil)
+		if err == nil && ok {
+			return ip, nil
+		} else if err != nil && err != store.ErrKeyExists {
+			return nil, fmt.Errorf("could not claim dhcpd address %v: %v", ip, err)
+		}
+		// Claimed before the plugin restarted
+		if pair, err := st.Get(key); err == nil && string(pair.Value) == host {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("all of dhcpd-address %v serve other hosts", config.DhcpdAddresses)
+}
+
+// listenServer gives the bridge the server address, so that it answers ARP
+// for it. The socket bound there only keeps the kernel from refusing
+// unicast requests, which are read off the tap like all others.
+func listenServer(ifi *net.Interface, addr net.IP) (net.PacketConn, error) {
+	li, err := netlink.LinkByIndex(ifi.Index)
+	if err != nil {
+		return nil, ErrNetlinkError{"find bridge by index", err}
+	}
+	// Without a subnet route, the host does not route the VLAN through it
+	if err := netlink.AddrAdd(li, serverAddr(addr)); err != nil && err != syscall.EEXIST {
+		return nil, ErrNetlinkError{"add server address to bridge", err}
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("could not open dhcpd socket: %v", err)
+	}
+	if err := setupServer(fd, ifi.Name, addr); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "dhcpd-"+ifi.Name)
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+func serverAddr(ip net.IP) *netlink.Addr {
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}}
+}
+
+func setupServer(fd int, iface string, addr net.IP) error {
+	// The dhcp IPAM relays through the wildcard address of the same port
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return fmt.Errorf("could not set SO_REUSEADDR: %v", err)
+	}
+	if err := syscall.BindToDevice(fd, iface); err != nil {
+		return fmt.Errorf("could not bind dhcpd socket to %s: %v", iface, err)
+	}
+	sa := &syscall.SockaddrInet4{Port: dhcp.ServerPort}
+	copy(sa.Addr[:], addr.To4())
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fmt.Errorf("could not bind dhcpd socket to %v:%d: %v", addr, dhcp.ServerPort, err)
+	}
+	return nil
+}
+
+func (d *dhcpd) stop() error {
+	if d.sink != nil {
+		d.sink.Close()
+		// Another host may claim the address next
+		if li, err := netlink.LinkByIndex(d.ifi.Index); err == nil {
+			netlink.AddrDel(li, serverAddr(d.addr))
+		}
+		if err := d.shared.Delete(_dhcpdServer(d.config.SubnetIPv4, d.addr)); err != nil {
+			Log.Warnf("Could not free dhcpd address %v: %v", d.addr, err)
+		}
+	}
+	return d.pc.Close()
+}
+
+// address identifies the server to clients
+func (d *dhcpd) address() net.IP {
+	if d.addr != nil {
+		return d.addr
+	}
+	return d.config.GatewayIPv4
+}
+
+// ours tells whether p is meant for this server, going by the server
+// identifier clients send once they chose a server
+func (d *dhcpd) ours(p *dhcp.Packet) bool {
+	id := p.Options.IP(dhcp.OptionServerIdentifier)
+	return id == nil || id.Equal(d.address())
+}
+
+// pool returns the range addresses are handed out from
+func (d *dhcpd) pool() *net.IPNet {
+	if d.config.DhcpdRange != nil {
+		return d.config.DhcpdRange
+	}
+	return d.config.SubnetIPv4
+}
+
+func (d *dhcpd) serve() {
+	buf := make([]byte, d.ifi.MTU+64)
+	for {
+		n, _, err := d.pc.ReadFrom(buf)
+		if err != nil {
+			Log.Debugf("Stopped serving dhcp on %s: %v", d.ifi.Name, err)
+			return
+		}
+		var f ethernet.Frame
+		if err := f.UnmarshalBinary(buf[:n]); err != nil || f.EtherType != ethernet.EtherTypeIPv4 {
+			continue
+		}
+		payload, _, ok := dhcp.Decapsulate(f.Payload, dhcp.ServerPort)
+		if !ok {
+			continue
+		}
+		p, err := dhcp.Unmarshal(payload)
+		// Relayed requests belong to other servers
+		if err != nil || p.Op != dhcp.BootRequest || len(p.CHAddr) != 6 || !p.GIAddr.IsUnspecified() {
+			continue
+		}
+		if !RegisteredMAC(p.CHAddr, d.shared, d.local) {
+			Log.Debugf("Ignoring %v of unknown %v on %s", p.Type(), p.CHAddr, d.ifi.Name)
+			continue
+		}
+		if err := d.handle(p); err != nil {
+			Log.Warnf("Could not answer %v on %s: %v", p, d.ifi.Name, err)
+		}
+	}
+}
+
+func (d *dhcpd) handle(p *dhcp.Packet) error {
+	Log.Debugf("Dhcpd %s received %v", d.ifi.Name, p)
+	switch p.Type() {
+	case dhcp.Discover:
+		l, err := d.lease(p.CHAddr, p.Options.IP(dhcp.OptionRequestedIPAddress))
+		if _, ok := err.(ErrAddressInUse); ok || err == errOutsidePool {
+			// Offer something else instead
+			l, err = d.lease(p.CHAddr, nil)
+		}
+		if err != nil {
+			return err
+		}
+		return d.reply(p, dhcp.Offer, l.IP)
+	case dhcp.Request:
+		if !d.ours(p) {
+			// Client went with another server
+			return nil
+		}
+		want := p.Options.IP(dhcp.OptionRequestedIPAddress)
+		if want == nil {
+			want = p.CIAddr
+		}
+		l, err := d.lease(p.CHAddr, want)
+		if err != nil {
+			if _, ok := err.(ErrAddressInUse); ok || err == errOutsidePool {
+				return d.reply(p, dhcp.Nak, nil)
+			}
+			return err
+		}
+		if !l.IP.Equal(want) {
+			return d.reply(p, dhcp.Nak, nil)
+		}
+		return d.reply(p, dhcp.Ack, l.IP)
+	case dhcp.Decline:
+		if !d.ours(p) {
+			return nil
+		}
+		return d.decline(p.CHAddr, p.Options.IP(dhcp.OptionRequestedIPAddress))
+	case dhcp.Release:
+		if !d.ours(p) {
+			return nil
+		}
+		return dhcpdRelease(d.shared, d.config.SubnetIPv4, p.CHAddr)
+	case dhcp.Inform:
+		return d.reply(p, dhcp.Ack, nil)
+	}
+	return nil
+}
+
+var errOutsidePool = fmt.Errorf("requested address is outside of the pool")
+
+// lease returns the lease of mac, taking want or any free address when it
+// has none. Leases are renewed on every call.
+func (d *dhcpd) lease(mac net.HardwareAddr, want net.IP) (*dhcpdLease, error) {
+	var (
+		st     = d.shared
+		subnet = d.config.SubnetIPv4
+		key    = _dhcpdLease(subnet, mac)
+		l      = &dhcpdLease{}
+	)
+	pair, err := st.Get(key)
+	if err == nil {
+		if err := json.Unmarshal(pair.Value, l); err != nil {
+			return nil, err
+		}
+	} else if err != store.ErrKeyNotFound {
+		return nil, err
+	} else {
+		if want != nil && (want.IsUnspecified() || !d.pool().Contains(want) || !d.allowed(want)) {
+			if !want.IsUnspecified() {
+				return nil, errOutsidePool
+			}
+			want = nil
+		}
+		l.IP, err = dipam.Claim(st, subnet, d.pool(), want, mac.String(), d.allowed)
+		if _, ok := err.(ErrPoolExhausted); ok && d.expire() > 0 {
+			l.IP, err = dipam.Claim(st, subnet, d.pool(), want, mac.String(), d.allowed)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.Expires = time.Now().Add(d.leaseTime())
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	if pair != nil {
+		_, _, err = st.AtomicPut(key, b, pair, nil)
+	} else if _, _, err = st.AtomicPut(key, b, nil, nil); err != nil {
+		// Another server took care of mac meanwhile
+		dipam.Unclaim(st, subnet, l.IP)
+	}
+	if err == store.ErrKeyExists || err == store.ErrKeyModified {
+		return d.lease(mac, want)
+	} else if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// allowed keeps the gateway, server and auxiliary addresses from clients
+func (d *dhcpd) allowed(ip net.IP) bool {
+	if ip.Equal(d.config.GatewayIPv4) || ip.Equal(d.address()) {
+		return false
+	}
+	for _, a := range d.config.DhcpdAddresses {
+		if ip.Equal(a) {
+			return false
+		}
+	}
+	for _, aux := range d.config.AuxIPv4 {
+		if ip.Equal(aux) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *dhcpd) leaseTime() time.Duration {
+	if d.config.DhcpdLease != 0 {
+		return d.config.DhcpdLease
+	}
+	return defaultDhcpdLease
+}
+
+// decline drops the lease of mac on ip. The address stays claimed for
+// dhcpdDeclineHold, keeping it from clients while someone else uses it.
+func (d *dhcpd) decline(mac net.HardwareAddr, ip net.IP) error {
+	Log.Warnf("Address %v declined by %v on %s", ip, mac, d.ifi.Name)
+	subnet := d.config.SubnetIPv4
+	key := _dhcpdLease(subnet, mac)
+	pair, err := d.shared.Get(key)
+	if err == store.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var l dhcpdLease
+	if err := json.Unmarshal(pair.Value, &l); err != nil {
+		return err
+	}
+	if !l.IP.Equal(ip) {
+		// Clients decline only what they were given
+		return nil
+	}
+	l.Expires = time.Now().Add(dhcpdDeclineHold)
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := d.shared.Put(_dhcpdDecline(subnet, ip), b, nil); err != nil {
+		return err
+	}
+	_, err = d.shared.AtomicDelete(key, pair)
+	return err
+}
+
+// expire frees addresses of leases which were not renewed in time, and of
+// declines held long enough, returning how many
+func (d *dhcpd) expire() int {
+	subnet := d.config.SubnetIPv4
+	return d.expireAll(_dhcpdLeases(subnet), "Lease") + d.expireAll(_dhcpdDeclines(subnet), "Hold on declined address")
+}
+
+func (d *dhcpd) expireAll(prefix, what string) int {
+	pairs, err := d.shared.List(prefix)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, pair := range pairs {
+		var l dhcpdLease
+		if err := json.Unmarshal(pair.Value, &l); err != nil || time.Now().Before(l.Expires) {
+			continue
+		}
+		if ok, err := d.shared.AtomicDelete(pair.Key, pair); err != nil || !ok {
+			continue
+		}
+		Log.Infof("%s %v on %s expired", what, l.IP, d.ifi.Name)
+		if err := dipam.Unclaim(d.shared, d.config.SubnetIPv4, l.IP); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// dhcpdRelease drops the lease of mac in subnet and frees its address
+func dhcpdRelease(st store.Store, subnet *net.IPNet, mac net.HardwareAddr) error {
+	key := _dhcpdLease(subnet, mac)
+	pair, err := st.Get(key)
+	if err == store.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var l dhcpdLease
+	if err := json.Unmarshal(pair.Value, &l); err != nil {
+		return err
+	}
+	if _, err := st.AtomicDelete(key, pair); err != nil {
+		return err
+	}
+	Log.Infof("Released dhcpd lease of %v for %v", l.IP, mac)
+	return dipam.Unclaim(st, subnet, l.IP)
+}
+
+// reply answers rq with a message of type t handing out yiaddr
+func (d *dhcpd) reply(rq *dhcp.Packet, t dhcp.MessageType, yiaddr net.IP) error {
+	p := dhcp.NewPacket(t, rq.XID, rq.CHAddr)
+	p.Flags = rq.Flags
+	p.Options.SetIP(dhcp.OptionServerIdentifier, d.address())
+	if t != dhcp.Nak {
+		p.CIAddr = rq.CIAddr
+		p.YIAddr = yiaddr
+		p.Options.SetIP(dhcp.OptionSubnetMask, net.IP(d.config.SubnetIPv4.Mask))
+		p.Options.SetIP(dhcp.OptionRouter, d.config.GatewayIPv4)
+		if len(d.config.DhcpdDNS) > 0 {
+			p.Options.SetIP(dhcp.OptionDomainNameServer, d.config.DhcpdDNS...)
+		}
+		if t != dhcp.Ack || yiaddr != nil {
+			p.Options.SetDuration(dhcp.OptionIPAddressLeaseTime, d.leaseTime())
+		}
+	}
+
+	// RFC 2131 4.1, replies go where the client can receive them
+	var (
+		hwdst = rq.CHAddr
+		dst   = yiaddr
+	)
+	switch {
+	case t == dhcp.Nak || rq.Flags&dhcp.FlagBroadcast != 0:
+		hwdst, dst = ethernet.Broadcast, net.IPv4bcast
+	case !rq.CIAddr.IsUnspecified():
+		dst = rq.CIAddr
+	case yiaddr == nil:
+		hwdst, dst = ethernet.Broadcast, net.IPv4bcast
+	}
+	f := &ethernet.Frame{
+		Destination: hwdst,
+		Source:      d.ifi.HardwareAddr,
+		EtherType:   ethernet.EtherTypeIPv4,
+		Payload:     dhcp.Encapsulate(p.Marshal(), d.address(), dst, dhcp.ServerPort, dhcp.ClientPort),
+	}
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	Log.Debugf("Dhcpd %s sending %v", d.ifi.Name, p)
+	_, err = d.pc.WriteTo(b, &raw.Addr{HardwareAddr: hwdst})
+	return err
+}
@@ -6,10 +6,17 @@ import (
 	driverapi "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libkv/store"
 	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
 	"github.com/vishvananda/netlink"
+	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	. "github.com/xytis/polyp/common"
+	dipam "github.com/xytis/polyp/ipam"
 )
 
 const (
@@ -20,19 +27,42 @@ const (
 )
 
 type driver struct {
-	scope    string
-	store    store.Store
+	// Serializes link changes of requests and the reconciler
+	sync.Mutex
+	scope string
+	store store.Store
+	// Store of this host only
+	local    store.Store
 	networks networks
+	hooks    Hooks
 }
 
-func NewDriver(scope string, iface string, st store.Store) (driverapi.Driver, error) {
+// Hooks tell the IPAM of this host what the driver created, any may be nil
+type Hooks struct {
+	// Called with every IPAM pool of a network created
+	Network func(network, space string, subnet *net.IPNet)
+	// Called with every endpoint created
+	Endpoint func(mac net.HardwareAddr, endpoint string)
+}
+
+// NewDriver reconciles links with the stores, and keeps doing so every
+// reconcile unless that is 0.
+func NewDriver(scope string, iface string, st, local store.Store, reconcile time.Duration, hooks Hooks) (driverapi.Driver, error) {
 	if li, err := netlink.LinkByName(iface); err != nil {
 		return nil, fmt.Errorf("could not find base interface %s, (%v)", iface, err)
 	} else {
 		driver := &driver{
 			scope:    scope,
 			store:    st,
-			networks: networksNew(li, st),
+			local:    local,
+			networks: networksNew(li, st, local),
+			hooks:    hooks,
+		}
+		if err := driver.reconcile(); err != nil {
+			return nil, err
+		}
+		if reconcile > 0 {
+			go driver.reconcileEvery(reconcile, nil)
 		}
 
 		return driver, nil
@@ -59,6 +89,8 @@ func (driver *driver) CreateNetwork(rq *driverapi.CreateNetworkRequest) (err err
 		labels map[string]interface{}
 		ok     bool
 	)
+	driver.Lock()
+	defer driver.Unlock()
 	if labels, ok = rq.Options[netlabel.GenericData].(map[string]interface{}); !ok {
 		return ErrMissingParameterMap{}
 	}
@@ -87,15 +119,31 @@ func (driver *driver) CreateNetwork(rq *driverapi.CreateNetworkRequest) (err err
 	if err := config.parseLabels(labels); err != nil {
 		return err
 	}
-	if config.EnableIPv6 {
-		Log.Warnf("IPV6 not supported. Go code it yourself!")
+	if err := driver.networks.create(rq.NetworkID, config); err != nil {
+		return err
+	}
+	// The server has to answer address requests of the first endpoint
+	if config.Dhcpd {
+		if err := driver.networks.createLink(rq.NetworkID, config); err != nil {
+			driver.networks.delete(rq.NetworkID)
+			return err
+		}
+	}
+	if driver.hooks.Network != nil {
+		for _, data := range append(rq.IPv4Data, rq.IPv6Data...) {
+			if _, subnet, err := net.ParseCIDR(data.Pool); err == nil {
+				driver.hooks.Network(rq.NetworkID, data.AddressSpace, subnet)
+			}
+		}
 	}
-	return driver.networks.create(rq.NetworkID, config)
+	return nil
 }
 
 func (driver *driver) DeleteNetwork(rq *driverapi.DeleteNetworkRequest) (err error) {
 	Log.Debugf("Delete network request %s", rq.NetworkID)
 	defer func() { Log.Debugf("Delete network response (%v)", err) }()
+	driver.Lock()
+	defer driver.Unlock()
 	err = driver.networks.delete(rq.NetworkID)
 	return
 }
@@ -107,6 +155,8 @@ func (driver *driver) CreateEndpoint(rq *driverapi.CreateEndpointRequest) (res *
 		err = errors.New("invalid interface info passed")
 		return
 	}
+	driver.Lock()
+	defer driver.Unlock()
 
 	// Get the network handler and make sure it exists
 	ni, err := driver.networks.get(rq.NetworkID)
@@ -116,11 +166,24 @@ func (driver *driver) CreateEndpoint(rq *driverapi.CreateEndpointRequest) (res *
 	if err = ni.endpoints.vacant(rq.EndpointID); err != nil {
 		return
 	}
-	if err = driver.networks.createLink(ni.config); err != nil {
+	if err = driver.networks.createLink(rq.NetworkID, ni.config); err != nil {
 		return
 	}
 
-	err = ni.endpoints.create(rq.EndpointID, rq.Interface, ni.config)
+	if err = ni.endpoints.create(rq.EndpointID, rq.Interface, ni.config); err != nil {
+		return
+	}
+	ep, _ := ni.endpoints.get(rq.EndpointID)
+	if ni.config.Dhcpd {
+		if err = RegisterMAC(driver.local, ep.mac, rq.EndpointID); err != nil {
+			ni.endpoints.delete(rq.EndpointID)
+			return
+		}
+	}
+	if driver.hooks.Endpoint != nil {
+		// Outside of the driver lock, it may take a round trip
+		go driver.hooks.Endpoint(ep.mac, rq.EndpointID)
+	}
 	res = &driverapi.CreateEndpointResponse{
 		Interface: nil,
 	}
@@ -130,14 +193,28 @@ func (driver *driver) CreateEndpoint(rq *driverapi.CreateEndpointRequest) (res *
 func (driver *driver) DeleteEndpoint(rq *driverapi.DeleteEndpointRequest) (err error) {
 	Log.Debugf("Delete endpoint request %s:%s", rq.NetworkID, rq.EndpointID)
 	defer func() { Log.Debugf("Delete endpoint response (%v)", err) }()
+	driver.Lock()
+	defer driver.Unlock()
 	ni, err := driver.networks.get(rq.NetworkID)
 	if err != nil {
 		return err
 	}
 
+	ep, err := ni.endpoints.get(rq.EndpointID)
+	if err != nil {
+		return err
+	}
+	if ni.config.Dhcpd {
+		if err := UnregisterMAC(driver.local, ep.mac); err != nil {
+			Log.Warnf("Could not unregister %v: %v", ep.mac, err)
+		}
+		if err := dhcpdRelease(driver.store, ni.config.SubnetIPv4, ep.mac); err != nil {
+			Log.Warnf("Could not release dhcpd lease of %v: %v", ep.mac, err)
+		}
+	}
 	if err = ni.endpoints.delete(rq.EndpointID); err == nil {
-		if ni.endpoints.length() == 0 {
-			err = driver.networks.deleteLink(ni.config)
+		if ni.endpoints.length() == 0 && !ni.config.Dhcpd {
+			err = driver.networks.deleteLink(rq.NetworkID, ni.config)
 		}
 	}
 	return err
@@ -164,14 +241,68 @@ func (driver *driver) Join(rq *driverapi.JoinRequest) (res *driverapi.JoinRespon
 		return
 	}
 
+	// Gateway and routes are those of the subnet the address came from
+	s, _ := ni.config.subnetOf(ep.addr)
 	res = &driverapi.JoinResponse{
-		Gateway:       ni.config.GatewayIPv4.String(),
-		InterfaceName: driverapi.InterfaceName{ep.ifname, containerVethPrefix},
+		Gateway:       ni.config.gatewayOf(ep.addr).String(),
+		InterfaceName: driverapi.InterfaceName{SrcName: ep.ifname, DstPrefix: containerVethPrefix},
+		StaticRoutes:  driver.leaseRoutes(ep, s.Subnet),
+	}
+	if ep.addrv6 != nil {
+		if gw := ni.config.gatewayOf(ep.addrv6); gw != nil {
+			res.GatewayIPv6 = gw.String()
+		}
 	}
 
 	return
 }
 
+// leaseRoutes returns static routes the DHCP server sent along with the
+// endpoint lease, if the dhcp IPAM on this host holds one. Routes through
+// routers outside of subnet, if known, are left out.
+func (driver *driver) leaseRoutes(ep endpoint, subnet *net.IPNet) []*driverapi.StaticRoute {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil
+	}
+	data, err := dipam.LeaseData(host, ep.mac, driver.store, driver.local)
+	if err != nil || data[dipam.DataRoutes] == "" {
+		return nil
+	}
+	var routes []*driverapi.StaticRoute
+	for _, r := range strings.Split(data[dipam.DataRoutes], ",") {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(parts[0])
+		hop := net.ParseIP(parts[1])
+		if err != nil || hop == nil {
+			Log.Warnf("Skipping unparseable route %q of %v", r, ep.addr)
+			continue
+		}
+		// Default route is set up by docker from the gateway
+		if ones, _ := dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		if subnet != nil && !hop.IsUnspecified() && !subnet.Contains(hop) {
+			Log.Warnf("Skipping route %q of %v, its router is outside of %v", r, ep.addr, subnet)
+			continue
+		}
+		route := &driverapi.StaticRoute{
+			Destination: dst.String(),
+			RouteType:   types.NEXTHOP,
+			NextHop:     hop.String(),
+		}
+		if hop.IsUnspecified() {
+			route.RouteType = types.CONNECTED
+			route.NextHop = ""
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
 func (driver *driver) Leave(rq *driverapi.LeaveRequest) (err error) {
 	Log.Debugf("Leave requested %s:%s", rq.NetworkID, rq.EndpointID)
 	defer func() { Log.Debugf("Leave response (%v)", err) }()
@@ -1,22 +1,46 @@
 package plugin
 
 import (
+	"encoding/json"
 	"fmt"
 	driverapi "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libkv/store"
 	"github.com/docker/libnetwork/netutils"
 	"github.com/docker/libnetwork/types"
 	"github.com/vishvananda/netlink"
 	"github.com/xytis/arp"
 	. "github.com/xytis/polyp/common"
 	"net"
+	"strings"
 	"sync"
 )
 
+func _endpoints(nid string) string {
+	return "polyp/endpoint/" + nid
+}
+
+func _endpoint(nid, eid string) string {
+	return _endpoints(nid) + "/" + eid
+}
+
 type endpoint struct {
-	ifname string
-	addr   net.IP
-	addrv6 net.IP
-	mac    net.HardwareAddr
+	// Host side of the veth pair, ifname moves into the sandbox
+	hostIfname string
+	ifname     string
+	addr       net.IP
+	addrv6     net.IP
+	mac        net.HardwareAddr
+}
+
+// Stored form of endpoint, kept in the local store so that endpoints
+// outlive restarts of polyp
+type endpointJSON struct {
+	NetworkID  string
+	HostIfName string
+	IfName     string
+	Addr       net.IP
+	AddrV6     net.IP `json:",omitempty"`
+	MAC        string
 }
 
 //Perform RARP reassign
@@ -38,16 +62,76 @@ func broadcastChange(li netlink.Link, en endpoint) error {
 
 type endpoints struct {
 	sync.RWMutex
+	nid   string
 	store map[string]endpoint
+	local store.Store
 }
 
-func endpointsNew() endpoints {
+func endpointsNew(nid string, local store.Store) endpoints {
 	return endpoints{
+		nid:   nid,
 		store: make(map[string]endpoint),
+		local: local,
 	}
 }
 
+// load picks up endpoints of the network created before a restart
+func (e *endpoints) load() error {
+	pairs, err := e.local.List(_endpoints(e.nid))
+	if err == store.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not list endpoints of %s, %v", e.nid, err)
+	}
+	e.Lock()
+	defer e.Unlock()
+	for _, pair := range pairs {
+		eid := strings.TrimPrefix(strings.TrimPrefix(pair.Key, "/"), _endpoints(e.nid)+"/")
+		if eid == pair.Key || strings.Contains(eid, "/") {
+			continue
+		}
+		var v endpointJSON
+		if err := json.Unmarshal(pair.Value, &v); err != nil {
+			Log.Warnf("Skipping unreadable endpoint %s: %v", pair.Key, err)
+			continue
+		}
+		ep := endpoint{
+			hostIfname: v.HostIfName,
+			ifname:     v.IfName,
+			addr:       v.Addr,
+			addrv6:     v.AddrV6,
+		}
+		if ep.mac, err = net.ParseMAC(v.MAC); err != nil {
+			Log.Warnf("Skipping endpoint %s of unparseable mac %q", pair.Key, v.MAC)
+			continue
+		}
+		e.store[eid] = ep
+		Log.Infof("Recovered endpoint %s (%s) of %v in network %s", eid, ep.hostIfname, ep.addr, e.nid)
+	}
+	return nil
+}
+
+func (e *endpoints) save(eid string, ep endpoint) error {
+	b, err := json.Marshal(endpointJSON{
+		NetworkID:  e.nid,
+		HostIfName: ep.hostIfname,
+		IfName:     ep.ifname,
+		Addr:       ep.addr,
+		AddrV6:     ep.addrv6,
+		MAC:        ep.mac.String(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.local.Put(_endpoint(e.nid, eid), b, nil); err != nil {
+		return fmt.Errorf("could not write key %s, %v", _endpoint(e.nid, eid), err)
+	}
+	return nil
+}
+
 func (e *endpoints) length() int {
+	e.RLock()
+	defer e.RUnlock()
 	return len(e.store)
 }
 
@@ -85,6 +169,9 @@ func (e *endpoints) create(eid string, ifInfo *driverapi.EndpointInterface, niCo
 			netlink.LinkDel(host)
 		}
 	}()
+	if err = netlink.LinkSetAlias(host, endpointAlias(e.nid, eid)); err != nil {
+		return types.InternalErrorf("failed to tag host side interface %s: %v", hostIfName, err)
+	}
 
 	// Get the sandbox side pipe interface handler
 	sbox, err := netlink.LinkByName(containerIfName)
@@ -119,17 +206,18 @@ func (e *endpoints) create(eid string, ifInfo *driverapi.EndpointInterface, niCo
 	}
 
 	// Create the sandbox side pipe interface
+	ep.hostIfname = hostIfName
 	ep.ifname = containerIfName
 	ep.addr, _, err = net.ParseCIDR(ifInfo.Address)
 	if err != nil {
 		return fmt.Errorf("ipv4 adress unparseable")
 	}
-	/*
-		_, ep.addrv6, err = net.ParseCIDR(ifInfo.AddressIPv6)
+	if ifInfo.AddressIPv6 != "" {
+		ep.addrv6, _, err = net.ParseCIDR(ifInfo.AddressIPv6)
 		if err != nil {
 			return fmt.Errorf("ipv6 adress unparseable")
 		}
-	*/
+	}
 
 	if ifInfo.MacAddress != "" {
 		ep.mac, err = net.ParseMAC(ifInfo.MacAddress)
@@ -160,13 +248,20 @@ func (e *endpoints) create(eid string, ifInfo *driverapi.EndpointInterface, niCo
 	}
 
 	if ep.addrv6 == nil && niConfig.EnableIPv6 {
-		return fmt.Errorf("IPV6 is not supported. Go and code it yourself.")
+		return fmt.Errorf("ipv6 address missing on a dual stack network")
 	}
 
-	e.add(eid, ep)
+	if err = e.add(eid, ep); err != nil {
+		return err
+	}
 
 	Log.Debugf("ep data at join: ip: %v, mac: %v", ep.addr, ep.mac)
 	broadcastChange(br, ep)
+	if ep.addrv6 != nil {
+		if err := advertiseChange(br, ep); err != nil {
+			Log.Warnf("Could not advertise %v: %v", ep.addrv6, err)
+		}
+	}
 
 	return nil
 }
@@ -181,24 +276,60 @@ func (e *endpoints) delete(eid string) (err error) {
 	defer func() {
 		if err != nil {
 			if e.vacant(eid) == nil {
-				e.add(eid, ep)
+				if err := e.add(eid, ep); err != nil {
+					Log.Warnf("Could not restore endpoint %s: %v", eid, err)
+				}
 			}
 		}
 	}()
 	e.rm(eid)
 
-	// Also make sure defer does not see this error either.
-	if link, err := netlink.LinkByName(ep.ifname); err == nil {
-		return netlink.LinkDel(link)
+	// Deleting either end removes the pair. Also make sure defer does not
+	// see this error either.
+	for _, name := range []string{ep.hostIfname, ep.ifname} {
+		if link, err := netlink.LinkByName(name); err == nil {
+			return netlink.LinkDel(link)
+		}
 	}
 
 	return
 }
 
-func (e *endpoints) add(eid string, endpoint endpoint) {
+// attach puts host ends of all endpoints back into the bridge, which may
+// have been recreated
+func (e *endpoints) attach(bridge string) {
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		Log.Warnf("Could not find bridge %s: %v", bridge, err)
+		return
+	}
 	e.RLock()
+	defer e.RUnlock()
+	for eid, ep := range e.store {
+		host, err := netlink.LinkByName(ep.hostIfname)
+		if err != nil {
+			Log.Warnf("Host side interface %s of endpoint %s is gone", ep.hostIfname, eid)
+			continue
+		}
+		if host.Attrs().MasterIndex == br.Attrs().Index {
+			continue
+		}
+		if err := netlink.LinkSetMaster(host, br.(*netlink.Bridge)); err != nil {
+			Log.Warnf("Could not add interface %s to bridge %s: %v", ep.hostIfname, bridge, err)
+			continue
+		}
+		Log.Infof("Added interface %s of endpoint %s back to bridge %s", ep.hostIfname, eid, bridge)
+	}
+}
+
+func (e *endpoints) add(eid string, endpoint endpoint) error {
+	if err := e.save(eid, endpoint); err != nil {
+		return err
+	}
+	e.Lock()
 	e.store[eid] = endpoint
-	e.RUnlock()
+	e.Unlock()
+	return nil
 }
 
 func (e *endpoints) vacant(eid string) error {
@@ -222,7 +353,10 @@ func (e *endpoints) get(eid string) (endpoint, error) {
 }
 
 func (e *endpoints) rm(eid string) {
-	e.RLock()
+	e.Lock()
 	delete(e.store, eid)
-	e.RUnlock()
+	e.Unlock()
+	if err := e.local.Delete(_endpoint(e.nid, eid)); err != nil && err != store.ErrKeyNotFound {
+		Log.Warnf("Could not delete key %s, %v", _endpoint(e.nid, eid), err)
+	}
 }
@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+	"github.com/vishvananda/netlink"
+	. "github.com/xytis/polyp/common"
+)
+
+const (
+	icmpNeighborAdvertisement = 136
+	// Override flag, replacing cached link-layer addresses
+	naFlagOverride     = 0x20
+	ndOptTargetLinkAdr = 2
+	protoICMPv6        = 58
+)
+
+var (
+	allNodes   = net.ParseIP("ff02::1")
+	allNodesHw = net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}
+)
+
+// Perform unsolicited neighbor advertisement (RFC 4861 7.2.6), the IPv6
+// counterpart of broadcastChange. It is sent on behalf of the endpoint.
+func advertiseChange(li netlink.Link, en endpoint) error {
+	cif, err := net.InterfaceByIndex(li.Attrs().Index)
+	if err != nil {
+		return fmt.Errorf("could not rediscover interface by index %d (%s): %v", li.Attrs().Index, li.Attrs().Name, err)
+	}
+	pc, err := raw.ListenPacket(cif, raw.Protocol(syscall.ETH_P_IPV6))
+	if err != nil {
+		return fmt.Errorf("could not bind packet socket to interface %s: %v", li.Attrs().Name, err)
+	}
+	defer pc.Close()
+	Log.Infof("Doing neighbor advertisement for ip: %v, mac: %v", en.addrv6, en.mac)
+
+	f := &ethernet.Frame{
+		Destination: allNodesHw,
+		Source:      en.mac,
+		EtherType:   ethernet.EtherTypeIPv6,
+		Payload:     neighborAdvert(en.addrv6, en.mac),
+	}
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = pc.WriteTo(b, &raw.Addr{HardwareAddr: allNodesHw})
+	return err
+}
+
+// neighborAdvert builds the IPv6 packet telling all nodes that ip is at mac
+func neighborAdvert(ip net.IP, mac net.HardwareAddr) []byte {
+	icmp := make([]byte, 24, 24+2+len(mac))
+	icmp[0] = icmpNeighborAdvertisement
+	icmp[4] = naFlagOverride
+	copy(icmp[8:24], ip.To16())
+	icmp = append(icmp, ndOptTargetLinkAdr, byte((2+len(mac)+7)/8))
+	icmp = append(icmp, mac...)
+	for len(icmp)%8 != 0 {
+		icmp = append(icmp, 0)
+	}
+	binary.BigEndian.PutUint16(icmp[2:4], icmpChecksum(ip, allNodes, icmp))
+
+	h := make([]byte, 40, 40+len(icmp))
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:6], uint16(len(icmp)))
+	h[6] = protoICMPv6
+	// Receivers drop neighbor discovery which crossed a router
+	h[7] = 255
+	copy(h[8:24], ip.To16())
+	copy(h[24:40], allNodes.To16())
+	return append(h, icmp...)
+}
+
+// icmpChecksum sums msg with the IPv6 pseudo header (RFC 2460 8.1)
+func icmpChecksum(src, dst net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.To16())
+	add(dst.To16())
+	pseudo := make([]byte, 8)
+	binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(msg)))
+	pseudo[7] = protoICMPv6
+	add(pseudo)
+	add(msg)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
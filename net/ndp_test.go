@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNeighborAdvert(t *testing.T) {
+	want, err := hex.DecodeString(strings.Replace(""+
+		// IPv6 header, hop limit 255, to all nodes
+		"60 00 00 00 00 20 3a ff 20 01 0d b8 00 01 00 00"+
+		" 00 42 ac ff fe 11 00 02 ff 02 00 00 00 00 00 00"+
+		" 00 00 00 00 00 00 00 01"+
+		// Neighbor advertisement with the override flag
+		" 88 00 f6 2a 20 00 00 00"+
+		" 20 01 0d b8 00 01 00 00 00 42 ac ff fe 11 00 02"+
+		// Target link-layer address
+		" 02 01 02 42 ac 11 00 02", " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("2001:db8:1:0:42:acff:fe11:2")
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	got := neighborAdvert(ip, mac)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got\n%x\nwant\n%x", got, want)
+	}
+	// Summed along with its checksum the message comes out as 0
+	if sum := icmpChecksum(ip, allNodes, got[40:]); sum != 0 {
+		t.Errorf("checksum does not verify, got %#04x", sum)
+	}
+}
+
+func TestICMPChecksum(t *testing.T) {
+	src, dst := net.ParseIP("fe80::1"), net.ParseIP("ff02::2")
+	tests := []struct {
+		msg  []byte
+		want uint16
+	}{
+		{[]byte{0x85, 0, 0, 0, 0, 0, 0, 0}, 0x7d36},
+		// Odd lengths are padded with a zero byte
+		{[]byte{0x85, 0, 0, 0, 1}, 0x7c39},
+	}
+	for _, tt := range tests {
+		if got := icmpChecksum(src, dst, tt.msg); got != tt.want {
+			t.Errorf("%x: got %#04x, want %#04x", tt.msg, got, tt.want)
+		}
+	}
+}
@@ -9,9 +9,12 @@ import (
 	"github.com/docker/libnetwork/types"
 	"github.com/vishvananda/netlink"
 	. "github.com/xytis/polyp/common"
+	dipam "github.com/xytis/polyp/ipam"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 func _network(nid string) string {
@@ -21,8 +24,11 @@ func _network(nid string) string {
 type networks struct {
 	sync.RWMutex
 	parent netlink.Link
-	store  map[string]network
+	store  map[string]*network
 	shared store.Store
+	local  store.Store
+	// Embedded DHCP servers by bridge name
+	servers map[string]*dhcpd
 }
 
 type network struct {
@@ -37,29 +43,84 @@ type networkConfig struct {
 	Vlan       int
 	Mtu        int
 	EnableIPv6 bool
-	// Internal fields set after ipam data parsing
+	// Embedded DHCP server, see dhcpd.go
+	Dhcpd      bool
+	DhcpdRange *net.IPNet
+	DhcpdLease time.Duration
+	DhcpdDNS   []net.IP
+	// Addresses servers answer from, one per host, empty in configs stored
+	// before they were required
+	DhcpdAddresses []net.IP `json:",omitempty"`
+	// Internal fields set after ipam data parsing, of the first subnet of
+	// each family
 	GatewayIPv4 net.IP
 	GatewayIPv6 net.IP
+	SubnetIPv4  *net.IPNet
+	SubnetIPv6  *net.IPNet
+	AuxIPv4     []net.IP
+	// All subnets of the network, including the first ones
+	Subnets []subnetConfig `json:",omitempty"`
 }
 
-func networksNew(li netlink.Link, st store.Store) networks {
+// subnetConfig is one of the IPAM pools of a network
+type subnetConfig struct {
+	Subnet *net.IPNet
+	// Nil for IPv6 subnets whose routers are advertised
+	Gateway net.IP
+}
+
+// subnetOf returns the subnet ip belongs to. Configs stored before networks
+// had several subnets only know the first of each family.
+func (c *networkConfig) subnetOf(ip net.IP) (subnetConfig, bool) {
+	subnets := c.Subnets
+	if len(subnets) == 0 {
+		subnets = []subnetConfig{{c.SubnetIPv4, c.GatewayIPv4}, {c.SubnetIPv6, c.GatewayIPv6}}
+	}
+	for _, s := range subnets {
+		if s.Subnet != nil && s.Subnet.Contains(ip) {
+			return s, true
+		}
+	}
+	return subnetConfig{}, false
+}
+
+// gatewayOf returns the gateway of the subnet ip belongs to, falling back
+// to the one of the first subnet of its family
+func (c *networkConfig) gatewayOf(ip net.IP) net.IP {
+	if s, ok := c.subnetOf(ip); ok {
+		return s.Gateway
+	} else if ip.To4() != nil {
+		return c.GatewayIPv4
+	}
+	return c.GatewayIPv6
+}
+
+func networksNew(li netlink.Link, st, local store.Store) networks {
 	return networks{
-		parent: li,
-		store:  make(map[string]network),
-		shared: st,
+		parent:  li,
+		store:   make(map[string]*network),
+		shared:  st,
+		local:   local,
+		servers: make(map[string]*dhcpd),
 	}
 }
 
-func networkNew(config networkConfig) network {
-	return network{
-		endpoints: endpointsNew(),
+func networkNew(nid string, config networkConfig, local store.Store) (*network, error) {
+	ni := &network{
+		endpoints: endpointsNew(nid, local),
 		config:    config,
 	}
+	return ni, ni.endpoints.load()
 }
 
-func (n *networks) createLink(config networkConfig) error {
+// createLink sets up the VLAN link and bridge of network nid, links it
+// creates are tagged as its own. Existing links are used only when polyp
+// created them, see usableLink.
+func (n *networks) createLink(nid string, config networkConfig) error {
 	//Link creation starts from checking if current vlan interface exists
-	if _, err := netlink.LinkByName(config.LinkName); err != nil {
+	if li, err := usableLink(nid, config.LinkName); err != nil {
+		return err
+	} else if li == nil {
 		//Try creating the link
 		la := netlink.NewLinkAttrs()
 		la.Name = config.LinkName
@@ -68,12 +129,18 @@ func (n *networks) createLink(config networkConfig) error {
 		if err := netlink.LinkAdd(vl); err != nil {
 			return ErrNetlinkError{"create vlan iface", err}
 		}
+		if err := netlink.LinkSetAlias(vl, networkAlias(nid)); err != nil {
+			netlink.LinkDel(vl)
+			return ErrNetlinkError{"tag vlan iface", err}
+		}
 		if err := netlink.LinkSetUp(vl); err != nil {
 			return ErrNetlinkError{"bring vlan iface up", err}
 		}
 	}
 	//Now check if bridge exists
-	if _, err := netlink.LinkByName(config.BridgeName); err != nil {
+	if li, err := usableLink(nid, config.BridgeName); err != nil {
+		return err
+	} else if li == nil {
 		//Try creating the bridge
 		la := netlink.NewLinkAttrs()
 		la.Name = config.BridgeName
@@ -81,6 +148,10 @@ func (n *networks) createLink(config networkConfig) error {
 		if err := netlink.LinkAdd(br); err != nil {
 			return ErrNetlinkError{"create bridge", err}
 		}
+		if err := netlink.LinkSetAlias(br, networkAlias(nid)); err != nil {
+			netlink.LinkDel(br)
+			return ErrNetlinkError{"tag bridge", err}
+		}
 		//Link bridge to new interface
 		if li, err := netlink.LinkByName(config.LinkName); err != nil {
 			netlink.LinkDel(br)
@@ -93,20 +164,75 @@ func (n *networks) createLink(config networkConfig) error {
 			return ErrNetlinkError{"bring bridge up", err}
 		}
 	}
+	if config.Dhcpd {
+		return n.serveDhcp(config)
+	}
 
 	return nil
 }
 
-func (n *networks) deleteLink(config networkConfig) error {
-	if li, err := netlink.LinkByName(config.BridgeName); err == nil {
-		if err := netlink.LinkSetDown(li); err != nil {
+// usableLink returns the link called name, nil if there is none. Network
+// nid uses its own links, adopts those the IPAM created for DHCP of its
+// pool, and shares those of other networks on the same VLAN. Links polyp
+// did not create are refused.
+func usableLink(nid, name string) (netlink.Link, error) {
+	li, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, nil
+	}
+	alias := li.Attrs().Alias
+	if alias == dipam.LinkAlias {
+		if err := netlink.LinkSetAlias(li, networkAlias(nid)); err != nil {
+			return nil, ErrNetlinkError{"tag " + name, err}
+		}
+		Log.Infof("Network %s adopted %s", nid, name)
+	} else if _, eid, ok := parseAlias(alias); !ok || eid != "" {
+		return nil, ErrLinkExists(name)
+	}
+	return li, nil
+}
+
+// serveDhcp starts the embedded DHCP server of the bridge, unless it runs
+func (n *networks) serveDhcp(config networkConfig) error {
+	n.Lock()
+	defer n.Unlock()
+	if _, ok := n.servers[config.BridgeName]; ok {
+		return nil
+	}
+	d, err := dhcpdStart(config, n.shared, n.local)
+	if err != nil {
+		return err
+	}
+	n.servers[config.BridgeName] = d
+	return nil
+}
+
+// stopDhcp stops the embedded DHCP server of the bridge, if one runs
+func (n *networks) stopDhcp(bridge string) {
+	n.Lock()
+	defer n.Unlock()
+	if d, ok := n.servers[bridge]; ok {
+		d.stop()
+		delete(n.servers, bridge)
+	}
+}
+
+// deleteLink deletes the bridge and VLAN link of network nid, if tagged as
+// its own
+func (n *networks) deleteLink(nid string, config networkConfig) error {
+	br, err := netlink.LinkByName(config.BridgeName)
+	if err != nil || br.Attrs().Alias == networkAlias(nid) {
+		n.stopDhcp(config.BridgeName)
+	}
+	if err == nil && br.Attrs().Alias == networkAlias(nid) {
+		if err := netlink.LinkSetDown(br); err != nil {
 			return ErrNetlinkError{"bring bridge down", err}
 		}
-		if err := netlink.LinkDel(li); err != nil {
+		if err := netlink.LinkDel(br); err != nil {
 			return ErrNetlinkError{"delete bridge", err}
 		}
 	}
-	if li, err := netlink.LinkByName(config.LinkName); err == nil {
+	if li, err := netlink.LinkByName(config.LinkName); err == nil && li.Attrs().Alias == networkAlias(nid) {
 		if err := netlink.LinkSetDown(li); err != nil {
 			return ErrNetlinkError{"bring vlan down", err}
 		}
@@ -131,8 +257,8 @@ func (n *networks) create(nid string, config networkConfig) (err error) {
 	//Save runtime information to local storage
 	if err := n.addLocal(
 		nid,
-		network{
-			endpointsNew(),
+		&network{
+			endpointsNew(nid, n.local),
 			config,
 			make(chan struct{}),
 		},
@@ -148,7 +274,7 @@ func (n *networks) delete(nid string) error {
 		if ni, err := n.getLocal(nid); err != nil {
 			return err
 		} else {
-			n.deleteLink(ni.config)
+			n.deleteLink(nid, ni.config)
 		}
 		n.rmLocal(nid)
 	}
@@ -172,7 +298,7 @@ func (n *networks) addGlobal(nid string, config networkConfig) error {
 	return nil
 }
 
-func (n *networks) addLocal(nid string, network network) error {
+func (n *networks) addLocal(nid string, network *network) error {
 	//Setup watcher for key delete
 	go func() {
 		stop := make(chan struct{})
@@ -187,8 +313,8 @@ func (n *networks) addLocal(nid string, network network) error {
 			case pair := <-events:
 				if pair == nil {
 					//If local link exist:
-					if net, err := n.getLocal(nid); err != nil {
-						defer n.deleteLink(net.config)
+					if net, err := n.getLocal(nid); err == nil {
+						defer n.deleteLink(nid, net.config)
 					}
 					defer n.rmLocal(nid)
 					return
@@ -199,13 +325,13 @@ func (n *networks) addLocal(nid string, network network) error {
 		}
 	}()
 
-	n.RLock()
+	n.Lock()
 	n.store[nid] = network
-	n.RUnlock()
+	n.Unlock()
 	return nil
 }
 
-func (n *networks) get(nid string) (network, error) {
+func (n *networks) get(nid string) (*network, error) {
 	if n.existLocal(nid) {
 		return n.getLocal(nid)
 	}
@@ -219,7 +345,9 @@ func (n *networks) get(nid string) (network, error) {
 }
 
 func (n *networks) existLocal(nid string) bool {
+	n.RLock()
 	_, ok := n.store[nid]
+	n.RUnlock()
 	return ok
 }
 
@@ -231,27 +359,27 @@ func (n *networks) existGlobal(nid string) bool {
 	}
 }
 
-func (n *networks) getLocal(nid string) (network, error) {
+func (n *networks) getLocal(nid string) (*network, error) {
 	//Check local storage
 	n.RLock()
 	ni, ok := n.store[nid]
 	n.RUnlock()
 	if !ok {
-		return network{}, ErrNoNetwork(nid)
+		return nil, ErrNoNetwork(nid)
 	}
 	return ni, nil
 }
 
-func (n *networks) getGlobal(nid string) (network, error) {
+func (n *networks) getGlobal(nid string) (*network, error) {
 	//Check if remote store contains the network configuration
 	if pair, err := n.shared.Get(_network(nid)); err == nil {
 		var c networkConfig
 		if err := json.Unmarshal(pair.Value, &c); err != nil {
-			return network{}, err
+			return nil, err
 		}
-		return networkNew(c), nil
+		return networkNew(nid, c, n.local)
 	} else {
-		return network{}, err
+		return nil, err
 	}
 }
 
@@ -263,33 +391,68 @@ func (n *networks) rmGlobal(nid string) error {
 }
 
 func (n *networks) rmLocal(nid string) {
-	n.RLock()
+	n.Lock()
 	delete(n.store, nid)
-	n.RUnlock()
+	n.Unlock()
 }
 
 func (c *networkConfig) parseIPAM(id string, ipamV4Data, ipamV6Data []*driverapi.IPAMData) error {
-	if len(ipamV4Data) > 1 || len(ipamV6Data) > 1 {
-		return types.ForbiddenErrorf("bridge driver doesni't support multiple subnets")
-	}
-
 	if len(ipamV4Data) == 0 {
 		return types.BadRequestErrorf("bridge network %s requires ipv4 configuration", id)
 	}
 
-	if ipamV4Data[0].Gateway == "" {
-		return types.BadRequestErrorf("bridge network %s requires ipv4 gateway from IPAM", id)
+	for _, data := range ipamV4Data {
+		Log.Debugf("IPAM: %v", *data)
+		if data.Gateway == "" {
+			return types.BadRequestErrorf("bridge network %s requires ipv4 gateway from IPAM", id)
+		}
+		s, err := parseSubnet(data)
+		if err != nil {
+			return err
+		}
+		c.Subnets = append(c.Subnets, s)
+		for _, aux := range data.AuxAddresses {
+			if ip, _, err := net.ParseCIDR(fmt.Sprint(aux)); err == nil {
+				c.AuxIPv4 = append(c.AuxIPv4, ip)
+			}
+		}
 	}
-	if gw, _, err := net.ParseCIDR(ipamV4Data[0].Gateway); err != nil {
-		return err
-	} else {
-		Log.Debugf("IPAM: %v", *ipamV4Data[0])
-		c.GatewayIPv4 = gw
+	c.SubnetIPv4, c.GatewayIPv4 = c.Subnets[0].Subnet, c.Subnets[0].Gateway
+
+	// Without a gateway containers route through whatever routers advertise
+	for k, data := range ipamV6Data {
+		Log.Debugf("IPAM: %v", *data)
+		s, err := parseSubnet(data)
+		if err != nil {
+			return err
+		}
+		c.Subnets = append(c.Subnets, s)
+		if k == 0 {
+			c.EnableIPv6 = true
+			c.SubnetIPv6, c.GatewayIPv6 = s.Subnet, s.Gateway
+		}
 	}
 
 	return nil
 }
 
+func parseSubnet(data *driverapi.IPAMData) (subnetConfig, error) {
+	var s subnetConfig
+	if _, subnet, err := net.ParseCIDR(data.Pool); err != nil {
+		return s, err
+	} else {
+		s.Subnet = subnet
+	}
+	if data.Gateway != "" {
+		if gw, _, err := net.ParseCIDR(data.Gateway); err != nil {
+			return s, err
+		} else {
+			s.Gateway = gw
+		}
+	}
+	return s, nil
+}
+
 func (c *networkConfig) parseLabels(labels map[string]interface{}) error {
 	var err error
 	for label, tlval := range labels {
@@ -303,6 +466,48 @@ func (c *networkConfig) parseLabels(labels map[string]interface{}) error {
 			if c.EnableIPv6, err = strconv.ParseBool(value); err != nil {
 				return parseErr(label, value, err.Error())
 			}
+		case "dhcpd":
+			if c.Dhcpd, err = strconv.ParseBool(value); err != nil {
+				return parseErr(label, value, err.Error())
+			}
+		case "dhcpd-range":
+			if _, c.DhcpdRange, err = net.ParseCIDR(value); err != nil {
+				return parseErr(label, value, err.Error())
+			}
+			ones, _ := c.DhcpdRange.Mask.Size()
+			if sones, _ := c.SubnetIPv4.Mask.Size(); ones < sones || !c.SubnetIPv4.Contains(c.DhcpdRange.IP) {
+				return parseErr(label, value, "range outside of the network subnet")
+			}
+		case "dhcpd-lease":
+			if c.DhcpdLease, err = time.ParseDuration(value); err != nil {
+				return parseErr(label, value, err.Error())
+			}
+		case "dhcpd-address":
+			for _, s := range strings.Split(value, ",") {
+				ip := net.ParseIP(strings.TrimSpace(s)).To4()
+				if ip == nil {
+					return parseErr(label, value, "not an ipv4 address")
+				}
+				c.DhcpdAddresses = append(c.DhcpdAddresses, ip)
+			}
+		case "dhcpd-dns":
+			for _, s := range strings.Split(value, ",") {
+				ip := net.ParseIP(strings.TrimSpace(s)).To4()
+				if ip == nil {
+					return parseErr(label, value, "not an ipv4 address")
+				}
+				c.DhcpdDNS = append(c.DhcpdDNS, ip)
+			}
+		}
+	}
+
+	// Routers of the VLAN may own the gateway, so servers need their own
+	if c.Dhcpd && len(c.DhcpdAddresses) == 0 {
+		return types.BadRequestErrorf("dhcpd needs dhcpd-address, addresses of the subnet to answer from, one per host")
+	}
+	for _, a := range c.DhcpdAddresses {
+		if !c.SubnetIPv4.Contains(a) || a.Equal(c.GatewayIPv4) || c.DhcpdRange != nil && c.DhcpdRange.Contains(a) {
+			return parseErr("dhcpd-address", a.String(), "must be in the network subnet, apart from the gateway and dhcpd-range")
 		}
 	}
 
@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	driverapi "github.com/docker/go-plugins-helpers/network"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestParseIPAM(t *testing.T) {
+	tests := []struct {
+		name    string
+		v4, v6  []*driverapi.IPAMData
+		subnets []string
+		gw4     string
+		gw6     string
+		ipv6    bool
+		err     bool
+	}{
+		{
+			name:    "ipv4",
+			v4:      []*driverapi.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+			subnets: []string{"10.1.0.0/24=10.1.0.1"},
+			gw4:     "10.1.0.1",
+		},
+		{
+			name: "several ipv4 subnets",
+			v4: []*driverapi.IPAMData{
+				{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"},
+				{Pool: "10.2.0.0/16", Gateway: "10.2.0.254/16"},
+			},
+			subnets: []string{"10.1.0.0/24=10.1.0.1", "10.2.0.0/16=10.2.0.254"},
+			gw4:     "10.1.0.1",
+		},
+		{
+			name: "dual stack",
+			v4:   []*driverapi.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+			v6: []*driverapi.IPAMData{
+				{Pool: "2001:db8:1::/64", Gateway: "2001:db8:1::1/64"},
+				{Pool: "2001:db8:2::/64", Gateway: "2001:db8:2::1/64"},
+			},
+			subnets: []string{"10.1.0.0/24=10.1.0.1", "2001:db8:1::/64=2001:db8:1::1", "2001:db8:2::/64=2001:db8:2::1"},
+			gw4:     "10.1.0.1",
+			gw6:     "2001:db8:1::1",
+			ipv6:    true,
+		},
+		// Routers advertise themselves
+		{
+			name:    "ipv6 without gateway",
+			v4:      []*driverapi.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+			v6:      []*driverapi.IPAMData{{Pool: "2001:db8:1::/64"}},
+			subnets: []string{"10.1.0.0/24=10.1.0.1", "2001:db8:1::/64=<nil>"},
+			gw4:     "10.1.0.1",
+			ipv6:    true,
+		},
+		{
+			name: "ipv4 without gateway",
+			v4: []*driverapi.IPAMData{
+				{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"},
+				{Pool: "10.2.0.0/24"},
+			},
+			err: true,
+		},
+		{name: "ipv6 only", v6: []*driverapi.IPAMData{{Pool: "2001:db8:1::/64"}}, err: true},
+		{name: "malformed pool", v4: []*driverapi.IPAMData{{Pool: "10.1.0.0", Gateway: "10.1.0.1/24"}}, err: true},
+		{name: "malformed gateway", v4: []*driverapi.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1"}}, err: true},
+	}
+	for _, tt := range tests {
+		var c networkConfig
+		err := c.parseIPAM("n1", tt.v4, tt.v6)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tt.name, c)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var subnets []string
+		for _, s := range c.Subnets {
+			subnets = append(subnets, s.Subnet.String()+"="+s.Gateway.String())
+		}
+		if !reflect.DeepEqual(subnets, tt.subnets) {
+			t.Errorf("%s: got subnets %v, want %v", tt.name, subnets, tt.subnets)
+		}
+		if c.SubnetIPv4.String() != c.Subnets[0].Subnet.String() || c.GatewayIPv4.String() != tt.gw4 {
+			t.Errorf("%s: got first ipv4 subnet %v via %v", tt.name, c.SubnetIPv4, c.GatewayIPv4)
+		}
+		if c.EnableIPv6 != tt.ipv6 || (tt.gw6 != "" && c.GatewayIPv6.String() != tt.gw6) {
+			t.Errorf("%s: got ipv6 %v via %v", tt.name, c.EnableIPv6, c.GatewayIPv6)
+		}
+	}
+}
+
+func TestGatewayOf(t *testing.T) {
+	c := networkConfig{
+		SubnetIPv4:  mustCIDR(t, "10.1.0.0/24"),
+		GatewayIPv4: net.ParseIP("10.1.0.1"),
+		SubnetIPv6:  mustCIDR(t, "2001:db8:1::/64"),
+		GatewayIPv6: net.ParseIP("2001:db8:1::1"),
+		Subnets: []subnetConfig{
+			{mustCIDR(t, "10.1.0.0/24"), net.ParseIP("10.1.0.1")},
+			{mustCIDR(t, "10.2.0.0/16"), net.ParseIP("10.2.0.254")},
+			{mustCIDR(t, "2001:db8:1::/64"), net.ParseIP("2001:db8:1::1")},
+			{mustCIDR(t, "2001:db8:2::/64"), nil},
+		},
+	}
+	// Stored before networks had several subnets
+	legacy := networkConfig{
+		SubnetIPv4:  c.SubnetIPv4,
+		GatewayIPv4: c.GatewayIPv4,
+	}
+	tests := []struct {
+		c       *networkConfig
+		ip      string
+		subnet  string
+		gateway string
+	}{
+		{&c, "10.1.0.5", "10.1.0.0/24", "10.1.0.1"},
+		{&c, "10.2.3.4", "10.2.0.0/16", "10.2.0.254"},
+		{&c, "2001:db8:1::5", "2001:db8:1::/64", "2001:db8:1::1"},
+		{&c, "2001:db8:2::5", "2001:db8:2::/64", "<nil>"},
+		// Outside of all subnets the first of the family is used
+		{&c, "10.3.0.5", "", "10.1.0.1"},
+		{&c, "2001:db8:3::5", "", "2001:db8:1::1"},
+		{&legacy, "10.1.0.5", "10.1.0.0/24", "10.1.0.1"},
+		{&legacy, "2001:db8:1::5", "", "<nil>"},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		s, ok := tt.c.subnetOf(ip)
+		if ok != (tt.subnet != "") || (ok && s.Subnet.String() != tt.subnet) {
+			t.Errorf("subnetOf(%s) = %v, %v, want %s", tt.ip, s.Subnet, ok, tt.subnet)
+		}
+		if gw := tt.c.gatewayOf(ip).String(); gw != tt.gateway {
+			t.Errorf("gatewayOf(%s) = %s, want %s", tt.ip, gw, tt.gateway)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package plugin
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/libkv/store"
+	"github.com/vishvananda/netlink"
+	. "github.com/xytis/polyp/common"
+	dipam "github.com/xytis/polyp/ipam"
+)
+
+// Links polyp creates carry an alias naming their owner, links without
+// one are never deleted by the reconciler. VLAN links and bridges are
+// tagged polyp:<network id>, host ends of veth pairs
+// polyp:<network id>/<endpoint id>.
+const aliasPrefix = "polyp:"
+
+func networkAlias(nid string) string {
+	return aliasPrefix + nid
+}
+
+func endpointAlias(nid, eid string) string {
+	return aliasPrefix + nid + "/" + eid
+}
+
+// parseAlias returns the owner of a tagged link, eid is empty for VLAN
+// links and bridges. Links the IPAM created for DHCP of a pool have no
+// owner yet, see dipam.LinkAlias.
+func parseAlias(alias string) (nid, eid string, ok bool) {
+	if !strings.HasPrefix(alias, aliasPrefix) || alias == dipam.LinkAlias {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(alias, aliasPrefix), "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1], true
+	}
+	return parts[0], "", true
+}
+
+// reconcileEvery runs the reconciler every interval until stop is closed
+func (driver *driver) reconcileEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := driver.reconcile(); err != nil {
+			Log.Warnf("Could not reconcile links: %v", err)
+		}
+	}
+}
+
+// reconcile brings links in line with the networks and endpoints kept in
+// the stores. Networks having endpoints on this host, or an embedded DHCP
+// server, get missing VLAN links and bridges recreated. Tagged links of
+// anything else are deleted, as is what remains of endpoints of networks
+// deleted meanwhile.
+func (driver *driver) reconcile() error {
+	driver.Lock()
+	defer driver.Unlock()
+	n := &driver.networks
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return ErrNetlinkError{"list links", err}
+	}
+	nids := map[string]bool{}
+	for _, li := range links {
+		if nid, _, ok := parseAlias(li.Attrs().Alias); ok {
+			nids[nid] = true
+		}
+	}
+	pairs, err := n.local.List(_endpoints(""))
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(strings.TrimPrefix(pair.Key, "/"), _endpoints(""))
+		if parts := strings.Split(key, "/"); len(parts) == 2 {
+			nids[parts[0]] = true
+		}
+	}
+
+	var (
+		// Networks whose links stay, and those to which nothing is done
+		// as the cluster store could not tell about them
+		wanted  = map[string]*network{}
+		unknown = map[string]bool{}
+		// Names of links wanted networks use, which may be shared
+		keep = map[string]bool{}
+	)
+	for nid := range nids {
+		ni, err := n.get(nid)
+		if err == store.ErrKeyNotFound {
+			n.forget(nid)
+			continue
+		} else if err != nil {
+			Log.Warnf("Leaving links of network %s alone: %v", nid, err)
+			unknown[nid] = true
+			continue
+		}
+		if ni.endpoints.length() == 0 && !ni.config.Dhcpd {
+			continue
+		}
+		wanted[nid] = ni
+		keep[ni.config.LinkName] = true
+		keep[ni.config.BridgeName] = true
+		if err := n.createLink(nid, ni.config); err != nil {
+			Log.Warnf("Could not restore links of network %s: %v", nid, err)
+			continue
+		}
+		ni.endpoints.attach(ni.config.BridgeName)
+	}
+
+	for _, li := range links {
+		name := li.Attrs().Name
+		nid, eid, ok := parseAlias(li.Attrs().Alias)
+		if !ok || unknown[nid] {
+			continue
+		}
+		if eid != "" {
+			if ni, ok := wanted[nid]; ok && ni.endpoints.vacant(eid) != nil {
+				continue
+			}
+		} else if _, ok := wanted[nid]; ok || keep[name] {
+			continue
+		}
+		n.stopDhcp(name)
+		if err := netlink.LinkDel(li); err != nil {
+			Log.Warnf("Could not delete orphaned link %s of network %s: %v", name, nid, err)
+			continue
+		}
+		Log.Infof("Deleted orphaned link %s of network %s", name, nid)
+	}
+	return nil
+}
+
+// forget drops the endpoints network nid had on this host, once the
+// network is gone from the cluster store
+func (n *networks) forget(nid string) {
+	pairs, err := n.local.List(_endpoints(nid))
+	if err != nil && err != store.ErrKeyNotFound {
+		Log.Warnf("Could not list endpoints of network %s: %v", nid, err)
+	}
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, "/")
+		// Prefix listing may catch networks sharing an ID prefix
+		if !strings.HasPrefix(key, _endpoints(nid)+"/") {
+			continue
+		}
+		if err := n.local.Delete(key); err != nil {
+			Log.Warnf("Could not delete key %s, %v", key, err)
+		} else {
+			Log.Infof("Dropped endpoint %s of deleted network %s", strings.TrimPrefix(key, _endpoints(nid)+"/"), nid)
+		}
+	}
+	n.rmLocal(nid)
+}
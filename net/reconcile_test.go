@@ -0,0 +1,32 @@
+package plugin
+
+import "testing"
+
+func TestParseAlias(t *testing.T) {
+	tests := []struct {
+		alias string
+		nid   string
+		eid   string
+		ok    bool
+	}{
+		{"polyp:n1", "n1", "", true},
+		{"polyp:n1/e1", "n1", "e1", true},
+		{networkAlias("n2"), "n2", "", true},
+		{endpointAlias("n2", "e2"), "n2", "e2", true},
+		// Only the first slash separates the endpoint
+		{"polyp:n1/e1/x", "n1", "e1/x", true},
+		// Created by the IPAM, owned by nobody yet
+		{"polyp:", "", "", false},
+		{"", "", "", false},
+		{"uplink to core", "", "", false},
+		{"docker:n1", "", "", false},
+		{"POLYP:n1", "", "", false},
+		{" polyp:n1", "", "", false},
+	}
+	for _, tt := range tests {
+		nid, eid, ok := parseAlias(tt.alias)
+		if nid != tt.nid || eid != tt.eid || ok != tt.ok {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q, %v", tt.alias, nid, eid, ok, tt.nid, tt.eid, tt.ok)
+		}
+	}
+}